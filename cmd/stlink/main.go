@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rikvdh/go-stlink"
@@ -10,10 +11,15 @@ import (
 
 var (
 	serial = flag.String("serial", "", "ST-link serial, probe when empty")
+	path   = flag.String("path", "", "USB path of the ST-link, like 1-4.2")
 	flash  = flag.Bool("f", false, "flash or no..")
+	image  = flag.String("image", "", "binary image to flash with -f")
+	addr   = flag.Uint("addr", 0x08000000, "flash address of the image")
+	vpp    = flag.Bool("vpp", false, "Vpp is applied, for x64 programming of the STM32F2/F4/F7")
 	halt   = flag.Bool("h", false, "halt the core")
 	run    = flag.Bool("r", false, "run")
 	reset  = flag.Bool("re", false, "reset")
+	clock  = flag.Uint("clock", 0, "SWD clock speed in kHz, firmware default when 0")
 )
 
 func main() {
@@ -23,21 +29,29 @@ func main() {
 		logrus.Fatalf("error getting Stlink context: %v\n", err)
 	}
 
-	if *serial == "" {
+	if *serial == "" && *path == "" {
 		devs, err := s.Probe()
 		if err != nil {
 			logrus.Fatalf("probe failed: %v\n", err)
 		}
 		logrus.Infof("found %d devices", len(devs))
 		for _, d := range devs {
-			probeDevice(s, d.SerialNumber)
+			fw, voltage, err := d.QueryProbe()
+			if err != nil {
+				logrus.Infof("%s at %s: %s %s, %v",
+					d.SerialNumber, d.Path, d.Manufacturer, d.Product, err)
+			} else {
+				logrus.Infof("%s at %s: %s %s, firmware %s, target %.2fV",
+					d.SerialNumber, d.Path, d.Manufacturer, d.Product, fw, voltage)
+			}
+			probeDevice(s, d.SerialNumber, d.Path)
 		}
 	} else {
 		if *flash {
 			runFlash(s, *serial)
 		} else if *halt {
 			logrus.Infof("stlink: %s", *serial)
-			dv, err := s.OpenDevice(*serial)
+			dv, err := openDevice(s, *serial, *path)
 			if err != nil {
 				panic(err)
 			}
@@ -49,7 +63,7 @@ func main() {
 			fmt.Printf("%s", dv)
 		} else if *run {
 			logrus.Infof("stlink: %s", *serial)
-			dv, err := s.OpenDevice(*serial)
+			dv, err := openDevice(s, *serial, *path)
 			if err != nil {
 				panic(err)
 			}
@@ -57,22 +71,39 @@ func main() {
 			panic(dv.Run())
 		} else if *reset {
 			logrus.Infof("stlink: %s", *serial)
-			dv, err := s.OpenDevice(*serial)
+			dv, err := openDevice(s, *serial, *path)
 			if err != nil {
 				panic(err)
 			}
 			defer panic(dv.HardReset())
 			dv.Close()
 		} else {
-			probeDevice(s, *serial)
+			probeDevice(s, *serial, *path)
+		}
+	}
+}
+
+// openDevice opens an ST-link and applies the clock speed from the flags
+func openDevice(s *stlink.Stlink, serial, path string) (*stlink.Device, error) {
+	dv, err := s.OpenDevice(serial, stlink.OpenOptions{Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if *clock != 0 {
+		if err := dv.SetClockSpeed(*clock); err != nil {
+			dv.Close()
+			return nil, err
 		}
+		cs, _ := dv.ClockSpeedKHz()
+		logrus.Infof("%s clock: %d kHz", dv.Interface(), cs)
 	}
+	return dv, nil
 }
 
 func runFlash(s *stlink.Stlink, serial string) {
 	logrus.SetLevel(logrus.DebugLevel)
 	logrus.Debugf("stlink: %s", serial)
-	dv, err := s.OpenDevice(serial)
+	dv, err := openDevice(s, serial, *path)
 	if err != nil {
 		panic(err)
 	}
@@ -85,12 +116,41 @@ func runFlash(s *stlink.Stlink, serial string) {
 	if err := dv.EnterSWDMode(); err != nil {
 		panic(err)
 	}
+	if *image == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(*image)
+	if err != nil {
+		panic(err)
+	}
+	l, err := dv.FlashLoader()
+	if err != nil {
+		panic(err)
+	}
+	if *vpp {
+		v, ok := l.(stlink.VppSetter)
+		if !ok {
+			panic("the flash of the target has no Vpp")
+		}
+		if err := v.SetVpp(true); err != nil {
+			panic(err)
+		}
+	}
+	for _, sec := range l.Geometry().SectorsIn(uint32(*addr), uint32(len(data))) {
+		logrus.Infof("erasing %d KB at 0x%08x", sec.Size/1024, sec.Addr)
+	}
+	if err := stlink.WriteFlash(l, uint32(*addr), data); err != nil {
+		panic(err)
+	}
+	logrus.Infof("flashed %d bytes at 0x%08x", len(data), *addr)
 }
 
-func probeDevice(s *stlink.Stlink, serial string) {
+func probeDevice(s *stlink.Stlink, serial, path string) {
 	fmt.Printf("STlink: %s\n", serial)
-	dv, err := s.OpenDevice(serial)
+	dv, err := openDevice(s, serial, path)
 	if err != nil {
+		logrus.Errorf("opening %s at %s: %v", serial, path, err)
 		return
 	}
 	fmt.Printf("%s", dv)
@@ -4,6 +4,7 @@ type stlinkCmd uint8
 
 const (
 	stlinkCmdGetVersion       stlinkCmd = 0xf1
+	stlinkCmdGetVersionEx     stlinkCmd = 0xfb
 	stlinkCmdDebug            stlinkCmd = 0xf2
 	stlinkCmdDfu              stlinkCmd = 0xf3
 	stlinkCmdDfuExit          stlinkCmd = 0x07
@@ -16,7 +17,10 @@ const (
 	stlinkCmdDebugForce               stlinkCmd = 0x02
 	stlinkCmdDebugResetsys            stlinkCmd = 0x03
 	stlinkCmdDebugReadallregs         stlinkCmd = 0x04
+	stlinkCmdDebugAPIV1ReadReg        stlinkCmd = 0x05
+	stlinkCmdDebugAPIV1WriteReg       stlinkCmd = 0x06
 	stlinkCmdDebugReadMem32           stlinkCmd = 0x07
+	stlinkCmdDebugReadMem8            stlinkCmd = 0x0c
 	stlinkCmdDebugWriteMem32          stlinkCmd = 0x08
 	stlinkCmdDebugWriteMem8           stlinkCmd = 0x0d
 	stlinkCmdDebugEnterMode           stlinkCmd = 0x20
@@ -27,11 +31,24 @@ const (
 	stlinkCmdDebugWriteReg            stlinkCmd = 0x34
 	stlinkCmdDebugRunCore             stlinkCmd = 0x09
 	stlinkCmdDebugStepCore            stlinkCmd = 0x0a
-	stlinkCmdDebugWriteRegpc          stlinkCmd = 0x34
+	stlinkCmdDebugWriteRegpc          stlinkCmd = 0x34 // WRITEREG with the PC
 	stlinkCmdDebugHardReset           stlinkCmd = 0x3c
 	stlinkCmdDebugReadcoreregs        stlinkCmd = 0x3a
 	stlinkCmdDebugSetfp               stlinkCmd = 0x0b
 	stlinkCmdDebugJtagWritedebug32bit stlinkCmd = 0x35
 	stlinkCmdDebugJtagReaddebug32bit  stlinkCmd = 0x36
 	stlinkCmdDebugSwdSetFreq          stlinkCmd = 0x43
+	stlinkCmdDebugJtagSetFreq         stlinkCmd = 0x44
+	stlinkCmdDebugGetLastRWStatus     stlinkCmd = 0x3b
+	stlinkCmdDebugGetLastRWStatus2    stlinkCmd = 0x3e
+	stlinkCmdDebugReadMem16           stlinkCmd = 0x47
+	stlinkCmdDebugWriteMem16          stlinkCmd = 0x48
+
+	// API v2 variants of API v1 commands, the V3 only supports these
+	stlinkCmdDebugAPIV2EnterMode   stlinkCmd = 0x30
+	stlinkCmdDebugAPIV2ReadIDCodes stlinkCmd = 0x31
+	stlinkCmdDebugAPIV2Resetsys    stlinkCmd = 0x32
+
+	stlinkCmdDebugAPIV3SetComFreq stlinkCmd = 0x61
+	stlinkCmdDebugAPIV3GetComFreq stlinkCmd = 0x62
 )
@@ -1,55 +1,105 @@
 package stlink
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/gousb"
 )
 
-const (
-	cmdSize           = 16
-	stlinkUsbInEp     = 1
-	stlinkUsbOutEpV2  = 2
-	stlinkUsbOutEpV21 = 1
-)
+const cmdSize = 16
 
-// Device represents a ST-link device
+// Device represents a ST-link device. A Device is safe for concurrent use,
+// every command and its response form a single transaction. A core halted
+// for an operation stays halted until every operation which needs it is
+// done, and register transfers through DCRSR don't interleave. Other
+// sequences of commands are not atomic. A Device must not be copied.
 type Device struct {
 	SerialNumber string
 	PID          gousb.ID
+	// Path, Manufacturer and Product are those of ProbeInfo
+	Path         string
+	Manufacturer string
+	Product      string
+	// query opens the probe of a device from Stlink.Probe to read its
+	// firmware version and target voltage
+	query func() (ProbeVersion, float32, error)
+
+	// mu serializes transactions and guards the fields below, version
+	// and caps are fixed after init
+	mu        sync.Mutex
+	tr        Transport
+	opened    bool
+	coreState StlinkStatus
+	cpuID     uint32
+	version   ProbeVersion
+	caps      Capabilities
+	iface     DebugInterface
+	clockKHz  uint
+	timeout   time.Duration
+	// resync is set when a transfer timed out, its response may still
+	// arrive and has to be discarded
+	resync bool
 
-	dev          *gousb.Device
-	interf       *gousb.Interface
-	doneFunc     func()
-	outEp        *gousb.OutEndpoint
-	inEp         *gousb.InEndpoint
-	opened       bool
-	coreState    StlinkStatus
-	cpuID        uint32
+	// haltMu guards a temporary halt, see haltTemporarily. haltRefs
+	// counts the operations that need the core halted, resumeCore is set
+	// when the last of them runs the core again
+	haltMu     sync.Mutex
+	haltRefs   int
+	resumeCore bool
+	// dcrsrMu serializes register transfers through DCRSR and the
+	// read-modify-write of the packed special registers
+	dcrsrMu sync.Mutex
+
+	// reconnect state, see device_reconnect.go
+	reconnectMu  sync.Mutex
+	opts         OpenOptions
+	reopen       func() (Transport, error)
+	reconnecting bool
+	lost         bool
+	generation   uint
 }
 
-func (d *Device) init() error {
-	var err error
-	d.interf, d.doneFunc, err = d.dev.DefaultInterface()
-	if err != nil {
-		return err
+// NewDevice creates a Device for a probe with the given PID which is
+// reachable through t. The device is initialized like OpenDevice does,
+// on failure t is closed. At most one OpenOptions is used.
+func NewDevice(t Transport, pid gousb.ID, opts ...OpenOptions) (*Device, error) {
+	d := &Device{
+		PID:     pid,
+		tr:      t,
+		opened:  true,
+		timeout: DefaultTimeout,
 	}
-	d.inEp, err = d.interf.InEndpoint(stlinkUsbInEp)
-	if err != nil {
-		return err
+	var o OpenOptions
+	if len(opts) > 0 {
+		o = opts[0]
 	}
-
-	ep := stlinkUsbOutEpV2
-	if d.PID == StlinkV21PID {
-		ep = stlinkUsbOutEpV21
+	if o.Timeout != 0 {
+		d.timeout = o.Timeout
 	}
+	d.opts = o
+	if err := d.init(o); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
 
-	d.outEp, err = d.interf.OutEndpoint(ep)
+func (d *Device) init(opts OpenOptions) error {
+	var err error
+	d.version, err = d.readVersion()
 	if err != nil {
 		return err
 	}
+	d.caps = d.version.Capabilities()
+	return d.connect(opts)
+}
 
+// connect puts the probe in debug mode and connects to the target
+func (d *Device) connect(opts OpenOptions) error {
 	mode, err := d.Mode()
 	if err != nil {
 		return err
@@ -58,7 +108,7 @@ func (d *Device) init() error {
 	if mode == StlinkModeDfu {
 		err := d.ExitDFUMode()
 		if err != nil {
-			return nil
+			return err
 		}
 	}
 
@@ -66,12 +116,29 @@ func (d *Device) init() error {
 	if err != nil {
 		return err
 	}
-	if mode != StlinkModeDebug {
-		err := d.EnterSWDMode()
-		if err != nil {
+	if mode == StlinkModeDebug {
+		// The interface of an earlier session is unknown, start over
+		if err := d.ExitDebugMode(); err != nil {
 			return err
 		}
 	}
+	// The clock of an earlier session is unknown as well
+	d.setClockSpeed(0)
+	switch opts.Interface {
+	case DebugInterfaceSWD:
+		err = d.EnterSWDMode()
+		if err == nil && d.caps.Has(CapabilitySWDFreq) && !d.caps.Has(CapabilityAPIV3) {
+			// Start at the firmware default, so the clock is known
+			err = d.SetClockSpeed(1800)
+		}
+	case DebugInterfaceJTAG:
+		err = d.EnterJTAGMode()
+	default:
+		err = fmt.Errorf("unsupported debug interface %d", opts.Interface)
+	}
+	if err != nil {
+		return err
+	}
 
 	_, err = d.Status()
 	return err
@@ -79,43 +146,199 @@ func (d *Device) init() error {
 
 // Close closes the device when needed
 func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.opened {
-		if d.doneFunc != nil {
-			d.doneFunc()
-		}
-		return d.dev.Close()
+		d.opened = false
+		return d.tr.Close()
 	}
 	return nil
 }
 
 func (d *Device) Name() (string, error) {
-	switch d.PID {
+	return probeName(d.PID)
+}
+
+func (d *Device) setProbeInfo(p ProbeInfo) {
+	d.PID = p.PID
+	d.SerialNumber = p.SerialNumber
+	d.Path = p.Path
+	d.Manufacturer = p.Manufacturer
+	d.Product = p.Product
+}
+
+// QueryProbe reads the firmware version of the probe and the target
+// voltage it measures, without connecting to the target. For a device
+// from Stlink.Probe the probe is opened briefly, which fails when it is
+// in use.
+func (d *Device) QueryProbe() (ProbeVersion, float32, error) {
+	if d.query != nil {
+		return d.query()
+	}
+	v, err := d.TargetVoltage()
+	return d.version, v, err
+}
+
+// probeName returns the model name of the probe with the given PID
+func probeName(pid gousb.ID) (string, error) {
+	switch pid {
+	case stlinkV1PID:
+		return "ST-link V1", nil
 	case StlinkV2PID:
 		return "ST-link V2", nil
 	case StlinkV21PID:
 		return "ST-link V2-1", nil
+	case StlinkV21NoMSDPID:
+		return "ST-link V2-1 (no MSD)", nil
+	case StlinkV3EPID:
+		return "STLINK-V3E", nil
+	case StlinkV3PID:
+		return "STLINK-V3", nil
+	case StlinkV32VCPPID:
+		return "STLINK-V3 (2 VCP)", nil
+	case StlinkV3NoMSDPID:
+		return "STLINK-V3 (no MSD)", nil
+	case StlinkV3PwrPID:
+		return "STLINK-V3PWR", nil
 	}
 	return "", errors.New("unknown device")
 }
 
+// DefaultTimeout bounds every USB transfer of a device, unless it is
+// changed with OpenOptions.Timeout or SetTimeout
+const DefaultTimeout = time.Second
+
+const (
+	// drainTimeout is the time to wait for a late response
+	drainTimeout = 10 * time.Millisecond
+	// maxDrainReads limits draining a probe that keeps sending
+	maxDrainReads = 64
+)
+
+// SetTimeout sets the time a single USB transfer may take, a transfer
+// taking longer fails with context.DeadlineExceeded. Zero or less
+// waits forever.
+func (d *Device) SetTimeout(t time.Duration) {
+	d.mu.Lock()
+	d.timeout = t
+	d.mu.Unlock()
+}
+
+// Timeout returns the time a single USB transfer may take
+func (d *Device) Timeout() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.timeout
+}
+
+func (d *Device) transferContext() (context.Context, context.CancelFunc) {
+	if d.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d.timeout)
+}
+
+// transferDone checks err of a transfer, after a timeout the device
+// resyncs with the probe before the next command
+func (d *Device) transferDone(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		d.resync = true
+	}
+	return err
+}
+
+// drain discards any response the probe sends after a timed out
+// transfer, so it is not taken for the response of the next command
+func (d *Device) drain() {
+	d.resync = false
+	for i := 0; i < maxDrainReads; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		_, err := d.tr.Receive(ctx, d.drainSize())
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drainSize is the size of a single read while draining, a whole packet:
+// a smaller read of a full packet overflows
+func (d *Device) drainSize() int {
+	switch d.PID {
+	case StlinkV3EPID, StlinkV3PID, StlinkV32VCPPID, StlinkV3NoMSDPID, StlinkV3PwrPID:
+		return usbPacketSizeV3
+	}
+	return usbPacketSize
+}
+
 func (d *Device) write(b []byte) error {
 	if !d.opened {
 		return errors.New("device closed")
 	}
-	_, err := d.outEp.Write(b)
-	return err
+	if d.lost {
+		return ErrDisconnected
+	}
+	if d.resync {
+		d.drain()
+	}
+	ctx, cancel := d.transferContext()
+	defer cancel()
+	return d.transferDone(d.tr.SendCommand(ctx, b))
+}
+
+// writeData sends the data phase of the last command
+func (d *Device) writeData(b []byte) error {
+	if !d.opened {
+		return errors.New("device closed")
+	}
+	ctx, cancel := d.transferContext()
+	defer cancel()
+	return d.transferDone(d.tr.SendData(ctx, b))
 }
 
 func (d *Device) read(n int) ([]byte, error) {
 	if !d.opened {
 		return nil, errors.New("device closed")
 	}
-	rx := make([]byte, n, n)
-	_, err := d.inEp.Read(rx)
-	if err != nil {
+	ctx, cancel := d.transferContext()
+	defer cancel()
+	rx, err := d.tr.Receive(ctx, n)
+	return rx, d.transferDone(err)
+}
+
+// command sends tx and reads a response of n bytes, or none when n is 0,
+// as one transaction: no other command gets in between
+func (d *Device) command(tx []byte, n int) ([]byte, error) {
+	var rx []byte
+	err := d.transaction(func() error {
+		var err error
+		rx, err = d.exchange(tx, n)
+		return err
+	})
+	return rx, err
+}
+
+// commandStatus is command for a response which starts with the status
+// of a debug command, a failure status is returned as error
+func (d *Device) commandStatus(tx []byte, n int) ([]byte, error) {
+	var rx []byte
+	err := d.transaction(func() error {
+		var err error
+		rx, err = d.exchange(tx, n)
+		if err != nil {
+			return err
+		}
+		return statusError(rx[0])
+	})
+	return rx, err
+}
+
+func (d *Device) exchange(tx []byte, n int) ([]byte, error) {
+	err := d.write(tx)
+	if err != nil || n == 0 {
 		return nil, err
 	}
-	return rx, nil
+	return d.read(n)
 }
 
 func (d *Device) String() string {
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/google/gousb"
 )
 
 type StlinkMode uint8
@@ -31,11 +33,7 @@ func (s StlinkMode) String() string {
 func (d *Device) Mode() (StlinkMode, error) {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdGetCurrentMode)
-	err := d.write(tx)
-	if err != nil {
-		return StlinkModeUnknown, err
-	}
-	rx, err := d.read(2)
+	rx, err := d.command(tx, 2)
 	if err != nil {
 		return StlinkModeUnknown, err
 	}
@@ -61,40 +59,69 @@ func (d *Device) SetMode(mode StlinkMode) error {
 	return errors.New("not implemented")
 }
 
-func (d *Device) Version() (string, error) {
+func (d *Device) readVersion() (ProbeVersion, error) {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdGetVersion)
-	err := d.write(tx)
+	rx, err := d.command(tx, 6)
 	if err != nil {
-		return "", err
+		return ProbeVersion{}, err
 	}
-	rx, err := d.read(6)
-	if err != nil {
-		return "", err
+
+	v := ProbeVersion{
+		Stlink: uint8((rx[0] & 0xf0) >> 4),
+		JTAG:   uint8(((rx[0] & 0x0f) << 2) | ((rx[1] & 0xc0) >> 6)),
+		VID:    gousb.ID(binary.LittleEndian.Uint16(rx[2:])),
+		PID:    gousb.ID(binary.LittleEndian.Uint16(rx[4:])),
+	}
+	if v.v21() {
+		v.MSD = rx[1] & 0x3f
+	} else {
+		v.SWIM = rx[1] & 0x3f
+	}
+	if v.Stlink < 3 {
+		return v, nil
 	}
 
-	stlink := uint8((rx[0] & 0xf0) >> 4)
-	jtag := uint8(((rx[0] & 0x0f) << 2) | ((rx[1] & 0xc0) >> 6))
-	swim := uint8(rx[1] & 0x3f)
+	// The V3 no longer fits the version in GET_VERSION
+	tx = make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdGetVersionEx)
+	rx, err = d.command(tx, 12)
+	if err != nil {
+		return ProbeVersion{}, err
+	}
+	return ProbeVersion{
+		Stlink: rx[0],
+		SWIM:   rx[1],
+		JTAG:   rx[2],
+		MSD:    rx[3],
+		Bridge: rx[4],
+		VID:    gousb.ID(binary.LittleEndian.Uint16(rx[8:])),
+		PID:    gousb.ID(binary.LittleEndian.Uint16(rx[10:])),
+	}, nil
+}
 
-	return fmt.Sprintf("V%dJ%dS%d", stlink, jtag, swim), nil
+// Version returns the version of the probe as string, like V2J28S7.
+// Use ProbeVersion for the separate fields.
+func (d *Device) Version() (string, error) {
+	v, err := d.readVersion()
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
 }
 
 func (d *Device) TargetVoltage() (float32, error) {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdGetTargetVoltage)
-	err := d.write(tx)
+	rx, err := d.command(tx, 8)
 	if err != nil {
 		return 0, err
 	}
 
-	var v [2]int32
-	if err := binary.Read(d.inEp, binary.LittleEndian, &v); err != nil {
-		return 0, err
-	}
-
-	if v[0] == 0 {
+	v0 := int32(binary.LittleEndian.Uint32(rx[0:]))
+	v1 := int32(binary.LittleEndian.Uint32(rx[4:]))
+	if v0 == 0 {
 		return 0, errors.New("measured voltage is zero")
 	}
-	return 2.4 * float32(v[1]) / float32(v[0]), nil
+	return 2.4 * float32(v1) / float32(v0), nil
 }
@@ -0,0 +1,130 @@
+package stlink_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+// TestConcurrentUse runs with -race, it checks that concurrent commands
+// don't interleave and that each goroutine gets its own responses
+func TestConcurrentUse(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F407xG)
+	defer dev.Close()
+	cpuid := p.Target.Read(0xe000ed00, 4)
+
+	const workers = 8
+	const rounds = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*4)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// every worker has its own piece of RAM
+			addr := 0x20000000 + uint32(w)*0x100
+			buf := make([]byte, 40)
+			for r := 0; r < rounds; r++ {
+				data := bytes.Repeat([]byte{byte(w), byte(r)}, 20)
+				if err := dev.WriteMem(addr, data); err != nil {
+					errs <- err
+					return
+				}
+				if err := dev.ReadMem(addr, buf); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, data) {
+					errs <- fmt.Errorf("worker %d: read % x, wrote % x", w, buf, data)
+					return
+				}
+				if err := dev.Write32(addr+0x80, uint32(w<<16|r)); err != nil {
+					errs <- err
+					return
+				}
+				v, err := dev.Read32(addr + 0x80)
+				if err != nil || v != uint32(w<<16|r) {
+					errs <- fmt.Errorf("worker %d: Read32 = %08x, %v", w, v, err)
+					return
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				if _, err := dev.Status(); err != nil {
+					errs <- err
+					return
+				}
+				v, err := dev.CpuID()
+				if err != nil || v != cpuid {
+					errs <- fmt.Errorf("CpuID() = %08x, %v", v, err)
+					return
+				}
+				if _, err := dev.ReadAllRegisters(); err != nil {
+					errs <- err
+					return
+				}
+				dev.ClockSpeed()
+				dev.Interface()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentRegisters checks that register transfers through DCRSR
+// don't interleave and that a temporary halt lasts until the last
+// goroutine which needs it is done
+func TestConcurrentRegisters(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F407xG)
+	defer dev.Close()
+	for r := stlink.CoreRegisterS0; r <= stlink.CoreRegisterS31; r++ {
+		p.Target.Regs[r] = 0x3f800000 + uint32(r)
+	}
+	if err := dev.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const rounds = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				r := stlink.CoreRegisterS0 + stlink.CoreRegister((w*rounds+i)%32)
+				v, err := dev.ReadRegister(r)
+				if err != nil || v != 0x3f800000+uint32(r) {
+					errs <- fmt.Errorf("worker %d: ReadRegister(%s) = %08x, %v", w, r, v, err)
+					return
+				}
+				if err := dev.Write32(0x20000000+uint32(w)*4, uint32(i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if status, err := dev.Status(); err != nil || status != stlink.StlinkStatusCoreRunning {
+		t.Errorf("Status() after the reads = %v, %v", status, err)
+	}
+}
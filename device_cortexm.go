@@ -31,11 +31,15 @@ func (c CortexMPartNumber) String() string {
 }
 
 func (d *Device) CortexMPartNumber() (CortexMPartNumber, error) {
-	if d.cpuID == 0 {
-		_, err := d.CpuID()
+	d.mu.Lock()
+	id := d.cpuID
+	d.mu.Unlock()
+	if id == 0 {
+		var err error
+		id, err = d.CpuID()
 		if err != nil {
 			return CortexMPartNumberUnknown, err
 		}
 	}
-	return CortexMPartNumber((d.cpuID >> 4) & 0xfff), nil
+	return CortexMPartNumber((id >> 4) & 0xfff), nil
 }
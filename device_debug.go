@@ -3,6 +3,8 @@ package stlink
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"time"
 )
 
 type StlinkStatus uint8
@@ -24,92 +26,386 @@ func (s StlinkStatus) String() string {
 }
 
 func (d *Device) Status() (StlinkStatus, error) {
-	d.coreState = StlinkStatusUnknown
+	d.setCoreState(StlinkStatusUnknown)
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugGetStatus)
-	err := d.write(tx)
-	if err != nil {
-		return StlinkStatusUnknown, err
-	}
-
-	rx, err := d.read(2)
+	rx, err := d.command(tx, 2)
 	if err != nil {
 		return StlinkStatusUnknown, err
 	}
 
+	state := StlinkStatusUnknown
 	switch rx[0] {
 	case byte(StlinkStatusCoreRunning):
-		d.coreState = StlinkStatusCoreRunning
+		state = StlinkStatusCoreRunning
 	case byte(StlinkStatusCoreHalted):
-		d.coreState = StlinkStatusCoreHalted
-	default:
-		d.coreState = StlinkStatusUnknown
+		state = StlinkStatusCoreHalted
 	}
-	return d.coreState, nil
+	d.setCoreState(state)
+	return state, nil
 }
 
+func (d *Device) setCoreState(s StlinkStatus) {
+	d.mu.Lock()
+	d.coreState = s
+	d.mu.Unlock()
+}
+
+// StlinkClockSpeed is the SWD clock divider of the ST-link, the constant
+// names give the resulting frequency in kHz
 type StlinkClockSpeed uint16
 
 const (
 	StlinkClockSpeed4000 StlinkClockSpeed = 0
-	StlinkClockSpeed1800                  = 1
-	StlinkClockSpeed1200                  = 2
-	StlinkClockSpeed950                   = 3
-	StlinkClockSpeed480                   = 7
-	StlinkClockSpeed240                   = 15
-	StlinkClockSpeed125                   = 31
-	StlinkClockSpeed100                   = 40
-	StlinkClockSpeed50                    = 79
-	StlinkClockSpeed25                    = 158
-	StlinkClockSpeed15                    = 265
-	StlinkClockSpeed5                     = 798
+	StlinkClockSpeed1800 StlinkClockSpeed = 1
+	StlinkClockSpeed1200 StlinkClockSpeed = 2
+	StlinkClockSpeed950  StlinkClockSpeed = 3
+	StlinkClockSpeed480  StlinkClockSpeed = 7
+	StlinkClockSpeed240  StlinkClockSpeed = 15
+	StlinkClockSpeed125  StlinkClockSpeed = 31
+	StlinkClockSpeed100  StlinkClockSpeed = 40
+	StlinkClockSpeed50   StlinkClockSpeed = 79
+	StlinkClockSpeed25   StlinkClockSpeed = 158
+	StlinkClockSpeed15   StlinkClockSpeed = 265
+	StlinkClockSpeed5    StlinkClockSpeed = 798
 )
 
+// clockSpeed is a supported clock frequency and its divider
+type clockSpeed struct {
+	kHz     uint
+	divider uint16
+}
+
+// swdClockSpeeds lists the supported SWD clock speeds, fastest first
+var swdClockSpeeds = []clockSpeed{
+	{4000, uint16(StlinkClockSpeed4000)},
+	{1800, uint16(StlinkClockSpeed1800)},
+	{1200, uint16(StlinkClockSpeed1200)},
+	{950, uint16(StlinkClockSpeed950)},
+	{480, uint16(StlinkClockSpeed480)},
+	{240, uint16(StlinkClockSpeed240)},
+	{125, uint16(StlinkClockSpeed125)},
+	{100, uint16(StlinkClockSpeed100)},
+	{50, uint16(StlinkClockSpeed50)},
+	{25, uint16(StlinkClockSpeed25)},
+	{15, uint16(StlinkClockSpeed15)},
+	{5, uint16(StlinkClockSpeed5)},
+}
+
+// jtagClockSpeeds lists the supported JTAG clock speeds, fastest first
+var jtagClockSpeeds = []clockSpeed{
+	{18000, 2},
+	{9000, 4},
+	{4500, 8},
+	{2250, 16},
+	{1125, 32},
+	{562, 64},
+	{281, 128},
+	{140, 256},
+}
+
+// KHz returns the SWD frequency of the clock speed in kHz
+func (s StlinkClockSpeed) KHz() uint {
+	for _, c := range swdClockSpeeds {
+		if c.divider == uint16(s) {
+			return c.kHz
+		}
+	}
+	return 0
+}
+
+func (s StlinkClockSpeed) String() string {
+	return fmt.Sprintf("%d kHz", s.KHz())
+}
+
+// ClockSpeed returns the active SWD clock speed. On connect it is set to
+// the firmware default of 1.8 MHz when the firmware can set it. JTAG and
+// the V3 have no SWD divider, use ClockSpeedKHz for those.
 func (d *Device) ClockSpeed() (StlinkClockSpeed, error) {
-	return StlinkClockSpeed5, errors.New("not implemented")
+	kHz, err := d.ClockSpeedKHz()
+	if err != nil {
+		return 0, err
+	}
+	if d.Interface() == DebugInterfaceSWD && !d.caps.Has(CapabilityAPIV3) {
+		for _, c := range swdClockSpeeds {
+			if c.kHz == kHz {
+				return StlinkClockSpeed(c.divider), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%s clock of %d kHz is not an SWD divider", d.Interface(), kHz)
+}
+
+// ClockSpeedKHz returns the active clock speed of the debug interface in
+// kHz. For SWD this is the firmware default of 1.8 MHz until SetClockSpeed
+// is used, unless the firmware can't set it. Otherwise it is unknown until
+// then.
+func (d *Device) ClockSpeedKHz() (uint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clockKHz == 0 {
+		return 0, errors.New("clock speed unknown, it is not set yet")
+	}
+	return d.clockKHz, nil
+}
+
+func (d *Device) setClockSpeed(kHz uint) {
+	d.mu.Lock()
+	d.clockKHz = kHz
+	d.mu.Unlock()
+}
+
+// SetClockSpeed sets the clock of the debug interface to the fastest
+// supported speed not above kHz, or the slowest speed when kHz is below that.
+func (d *Device) SetClockSpeed(kHz uint) error {
+	speeds := swdClockSpeeds
+	cmd := stlinkCmdDebugSwdSetFreq
+	capability := CapabilitySWDFreq
+	if d.Interface() == DebugInterfaceJTAG {
+		speeds = jtagClockSpeeds
+		cmd = stlinkCmdDebugJtagSetFreq
+		capability = CapabilityJTAGFreq
+	}
+	if err := d.require(capability); err != nil {
+		return err
+	}
+	if d.caps.Has(CapabilityAPIV3) {
+		return d.setComFreq(kHz)
+	}
+	speed := speeds[len(speeds)-1]
+	for _, c := range speeds {
+		if c.kHz <= kHz {
+			speed = c
+			break
+		}
+	}
+
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(cmd)
+	binary.LittleEndian.PutUint16(tx[2:], speed.divider)
+	_, err := d.commandStatus(tx, 2)
+	if err != nil {
+		return err
+	}
+	d.setClockSpeed(speed.kHz)
+	return nil
+}
+
+// maxComFreqs is the maximum number of frequencies a V3 reports
+const maxComFreqs = 10
+
+// comFreqs reads the clock speeds in kHz the V3 supports for the
+// current debug interface
+func (d *Device) comFreqs() ([]uint, error) {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugAPIV3GetComFreq)
+	tx[2] = byte(d.Interface())
+	rx, err := d.commandStatus(tx, 52)
+	if err != nil {
+		return nil, err
+	}
+	n := int(rx[8])
+	if n > maxComFreqs {
+		n = maxComFreqs
+	}
+	freqs := make([]uint, n)
+	for i := range freqs {
+		freqs[i] = uint(binary.LittleEndian.Uint32(rx[12+4*i:]))
+	}
+	return freqs, nil
+}
+
+// setComFreq sets the clock speed of a V3, which has a table of supported
+// frequencies instead of dividers
+func (d *Device) setComFreq(kHz uint) error {
+	freqs, err := d.comFreqs()
+	if err != nil {
+		return err
+	}
+	if len(freqs) == 0 {
+		return errors.New("probe reports no supported clock speeds")
+	}
+	// the fastest not above kHz, otherwise the slowest
+	var speed uint
+	for _, f := range freqs {
+		if (f <= kHz && f > speed) || (speed > kHz && f < speed) || speed == 0 {
+			speed = f
+		}
+	}
+
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugAPIV3SetComFreq)
+	tx[2] = byte(d.Interface())
+	binary.LittleEndian.PutUint32(tx[4:], uint32(speed))
+	rx, err := d.commandStatus(tx, 8)
+	if err != nil {
+		return err
+	}
+	d.setClockSpeed(uint(binary.LittleEndian.Uint32(rx[4:])))
+	return nil
 }
 
+// HaltTimeout is the time Halt waits for the core to report it is halted
+const HaltTimeout = 500 * time.Millisecond
+
+// Halt halts the core through DHCSR and waits until the core reports it
+// is halted. A *TimeoutError is returned when it doesn't within HaltTimeout.
 func (d *Device) Halt() error {
-	return d.Step()
+	if err := d.writeDebug32(DHCSRReg, DHCSRHalt); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(HaltTimeout)
+	for {
+		v, err := d.Read32(DHCSRReg)
+		if err != nil {
+			return err
+		}
+		if v&DHCSRStatusHaltBit != 0 {
+			d.setCoreState(StlinkStatusCoreHalted)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			d.setCoreState(StlinkStatusUnknown)
+			return &TimeoutError{Op: "halt", Duration: HaltTimeout}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// haltTemporarily halts a running core, the returned function resumes
+// it again. It is deferred with the error result of the caller, which
+// gets the error of the resume unless it failed itself. Concurrent
+// callers share the halt, the core runs again when the last of them is
+// done. When the core is not known to be running nothing is done.
+func (d *Device) haltTemporarily() (func(*error), error) {
+	d.haltMu.Lock()
+	defer d.haltMu.Unlock()
+	if d.haltRefs == 0 {
+		d.mu.Lock()
+		state := d.coreState
+		d.mu.Unlock()
+		if state == StlinkStatusCoreRunning {
+			if err := d.Halt(); err != nil {
+				return nil, err
+			}
+			d.resumeCore = true
+		}
+	}
+	d.haltRefs++
+	return func(err *error) {
+		d.haltMu.Lock()
+		defer d.haltMu.Unlock()
+		d.haltRefs--
+		if d.haltRefs > 0 || !d.resumeCore {
+			return
+		}
+		d.resumeCore = false
+		if rerr := d.Run(); *err == nil {
+			*err = rerr
+		}
+	}, nil
 }
 
 func (d *Device) Step() error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugStepCore)
-	err := d.write(tx)
-	if err != nil {
-		return err
+	_, err := d.commandStatus(tx, 2)
+	if err == nil {
+		d.setCoreState(StlinkStatusCoreHalted)
 	}
-	_, err = d.read(2)
 	return err
 }
 
+// DebugInterface is the interface between the ST-link and the target
+type DebugInterface uint8
+
+const (
+	DebugInterfaceSWD  DebugInterface = 0
+	DebugInterfaceJTAG DebugInterface = 1
+)
+
+func (i DebugInterface) String() string {
+	switch i {
+	case DebugInterfaceSWD:
+		return "SWD"
+	case DebugInterfaceJTAG:
+		return "JTAG"
+	}
+	return "unknown"
+}
+
+// Interface returns the debug interface used to talk to the target
+func (d *Device) Interface() DebugInterface {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.iface
+}
+
 func (d *Device) EnterSWDMode() error {
+	err := d.enterMode(stlinkCmdDebugEnterSwd)
+	if err == nil {
+		d.mu.Lock()
+		d.iface = DebugInterfaceSWD
+		d.mu.Unlock()
+	}
+	return err
+}
+
+func (d *Device) EnterJTAGMode() error {
+	err := d.enterMode(stlinkCmdDebugEnterJtag)
+	if err == nil {
+		d.mu.Lock()
+		d.iface = DebugInterfaceJTAG
+		d.mu.Unlock()
+	}
+	return err
+}
+
+func (d *Device) enterMode(iface stlinkCmd) error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugEnterMode)
-	tx[2] = byte(stlinkCmdDebugEnterSwd)
-	return d.write(tx)
+	tx[2] = byte(iface)
+	if !d.caps.Has(CapabilityAPIV3) {
+		_, err := d.command(tx, 0)
+		return err
+	}
+	// The V3 only has the API v2 command, which returns a status
+	tx[1] = byte(stlinkCmdDebugAPIV2EnterMode)
+	_, err := d.commandStatus(tx, 2)
+	return err
+}
+
+// ExitDebugMode leaves the debug mode, the probe returns to mass-storage mode
+func (d *Device) ExitDebugMode() error {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugExit)
+	_, err := d.command(tx, 0)
+	return err
 }
 
 func (d *Device) ExitDFUMode() error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDfu)
 	tx[1] = byte(stlinkCmdDfuExit)
-	return d.write(tx)
+	_, err := d.command(tx, 0)
+	return err
 }
 
 func (d *Device) ForceDebug() error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugForce)
-	err := d.write(tx)
-	if err != nil {
-		return err
+	_, err := d.commandStatus(tx, 2)
+	if err == nil {
+		d.setCoreState(StlinkStatusCoreHalted)
 	}
-	_, err = d.read(2)
 	return err
 }
 
@@ -117,23 +413,27 @@ func (d *Device) Reset() error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugResetsys)
-	err := d.write(tx)
-	if err != nil {
-		return err
+	if d.caps.Has(CapabilityAPIV3) {
+		tx[1] = byte(stlinkCmdDebugAPIV2Resetsys)
+	}
+	_, err := d.commandStatus(tx, 2)
+	if err == nil {
+		d.setCoreState(StlinkStatusUnknown)
 	}
-	_, err = d.read(2)
 	return err
 }
 
 func (d *Device) HardReset() error {
+	if err := d.require(CapabilityAPIV2); err != nil {
+		return err
+	}
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugHardReset)
-	err := d.write(tx)
-	if err != nil {
-		return err
+	_, err := d.commandStatus(tx, 2)
+	if err == nil {
+		d.setCoreState(StlinkStatusUnknown)
 	}
-	_, err = d.read(2)
 	return err
 }
 
@@ -141,23 +441,30 @@ func (d *Device) Run() error {
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugRunCore)
-	err := d.write(tx)
+	_, err := d.commandStatus(tx, 2)
+	if err == nil {
+		d.setCoreState(StlinkStatusCoreRunning)
+	}
+	return err
+}
+
+func (d *Device) Write32(addr, w uint32) (err error) {
+	resume, err := d.haltTemporarily()
 	if err != nil {
 		return err
 	}
-	_, err = d.read(2)
-	return err
+	defer resume(&err)
+	return d.writeDebug32(addr, w)
 }
 
-func (d *Device) Write32(addr, w uint32) error {
-	if d.coreState == StlinkStatusCoreRunning {
-		d.Halt()
+// writeDebug32 writes a single word without touching the core state
+func (d *Device) writeDebug32(addr, w uint32) error {
+	if !d.caps.Has(CapabilityAPIV2) {
+		// The API v1 has no single word commands, a 4 byte transfer does
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, w)
+		return d.writeMem32(addr, b)
 	}
-	defer func() {
-		if d.coreState == StlinkStatusCoreRunning {
-			d.Run()
-		}
-	}()
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugJtagWritedebug32bit)
@@ -165,30 +472,29 @@ func (d *Device) Write32(addr, w uint32) error {
 	binary.LittleEndian.PutUint32(tx[2:], addr)
 	binary.LittleEndian.PutUint32(tx[6:], w)
 
-	err := d.write(tx)
-	if err != nil {
-		return err
-	}
-	_, err = d.read(8)
+	_, err := d.commandStatus(tx, 8)
 	return err
 }
 
 func (d *Device) Read32(addr uint32) (uint32, error) {
+	if !d.caps.Has(CapabilityAPIV2) {
+		b := make([]byte, 4)
+		if err := d.readMem32(addr, b); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(b), nil
+	}
 	tx := make([]byte, 6, 6)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugJtagReaddebug32bit)
 
 	binary.LittleEndian.PutUint32(tx[2:], addr)
 
-	err := d.write(tx)
+	rx, err := d.commandStatus(tx, 8)
 	if err != nil {
 		return 0, err
 	}
-	var v [2]uint32
-	if err := binary.Read(d.inEp, binary.LittleEndian, &v); err != nil {
-		return 0, err
-	}
-	return v[1], nil
+	return binary.LittleEndian.Uint32(rx[4:]), nil
 }
 
 func (d *Device) Read16(addr uint32) (uint16, error) {
@@ -3,21 +3,27 @@ package stlink
 const (
 	AIRCRReg uint32 = 0xe000ed0c
 	DHCSRReg uint32 = 0xe000edf0
+	DCRSRReg uint32 = 0xe000edf4
+	DCRDRReg uint32 = 0xe000edf8
 	DEMCRReg uint32 = 0xe000edfc
+	MVFR0Reg uint32 = 0xe000ef40
 
 	AIRCRKey            uint32 = 0x05fa0000
 	AIRCRSysResetReqBit uint32 = 0x00000004
 	AIRCRSysResetReq    uint32 = AIRCRKey | AIRCRSysResetReqBit
 
-	DHCSRKey           uint32 = 0xa05f0000
-	DHCSRDebugEnBit    uint32 = 0x00000001
-	DHCSRHaltBit       uint32 = 0x00000002
-	DHCSRStepBit       uint32 = 0x00000004
-	DHCSRStatusHaltBit uint32 = 0x00020000
-	DHCSRDebugDis      uint32 = DHCSRKey
-	DHCSRDebugEn       uint32 = DHCSRKey | DHCSRDebugEnBit
-	DHCSRHalt          uint32 = DHCSRKey | DHCSRDebugEnBit | DHCSRHaltBit
-	DHCSRStep          uint32 = DHCSRKey | DHCSRDebugEnBit | DHCSRStepBit
+	DHCSRKey               uint32 = 0xa05f0000
+	DHCSRDebugEnBit        uint32 = 0x00000001
+	DHCSRHaltBit           uint32 = 0x00000002
+	DHCSRStepBit           uint32 = 0x00000004
+	DHCSRStatusRegReadyBit uint32 = 0x00010000
+	DHCSRStatusHaltBit     uint32 = 0x00020000
+	DHCSRDebugDis          uint32 = DHCSRKey
+	DHCSRDebugEn           uint32 = DHCSRKey | DHCSRDebugEnBit
+	DHCSRHalt              uint32 = DHCSRKey | DHCSRDebugEnBit | DHCSRHaltBit
+	DHCSRStep              uint32 = DHCSRKey | DHCSRDebugEnBit | DHCSRStepBit
+
+	DCRSRRegWriteBit uint32 = 0x00010000
 
 	DEMCRRunAfterReset  uint32 = 0x00000000
 	DEMCRHaltAfterReset uint32 = 0x00000001
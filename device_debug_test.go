@@ -0,0 +1,126 @@
+package stlink_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestHalt(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	if err := dev.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := dev.Halt(); err != nil || !p.Target.Halted {
+		t.Fatalf("Halt() = %v, halted %v", err, p.Target.Halted)
+	}
+	if s, err := dev.Status(); err != nil || s != stlink.StlinkStatusCoreHalted {
+		t.Errorf("Status() = %s, %v", s, err)
+	}
+
+	if err := dev.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	p.Target.IgnoreHalt = true
+	start := time.Now()
+	err := dev.Halt()
+	var terr *stlink.TimeoutError
+	if !errors.As(err, &terr) || terr.Duration != stlink.HaltTimeout {
+		t.Fatalf("Halt of a core which does not halt: %v", err)
+	}
+	if d := time.Since(start); d < stlink.HaltTimeout {
+		t.Errorf("Halt gave up after %s", d)
+	}
+	if p.Target.Halted {
+		t.Error("core halted")
+	}
+}
+
+func TestSetClockSpeed(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	if cs, err := dev.ClockSpeed(); err != nil || cs != stlink.StlinkClockSpeed1800 ||
+		p.ClockDivider != uint16(stlink.StlinkClockSpeed1800) {
+		t.Errorf("ClockSpeed() before SetClockSpeed = %s, %v; divider %d", cs, err, p.ClockDivider)
+	}
+	tests := []struct {
+		kHz   uint
+		speed stlink.StlinkClockSpeed
+	}{
+		{10000, stlink.StlinkClockSpeed4000},
+		{4000, stlink.StlinkClockSpeed4000},
+		{2000, stlink.StlinkClockSpeed1800},
+		{1000, stlink.StlinkClockSpeed950},
+		{100, stlink.StlinkClockSpeed100},
+		{99, stlink.StlinkClockSpeed50},
+		{1, stlink.StlinkClockSpeed5},
+	}
+	for _, tc := range tests {
+		if err := dev.SetClockSpeed(tc.kHz); err != nil {
+			t.Fatalf("SetClockSpeed(%d): %v", tc.kHz, err)
+		}
+		if p.ClockDivider != uint16(tc.speed) {
+			t.Errorf("SetClockSpeed(%d) set divider %d, want %d", tc.kHz, p.ClockDivider, tc.speed)
+		}
+		cs, err := dev.ClockSpeed()
+		if err != nil || cs != tc.speed {
+			t.Errorf("ClockSpeed() after SetClockSpeed(%d) = %s, %v", tc.kHz, cs, err)
+		}
+		if kHz, err := dev.ClockSpeedKHz(); err != nil || kHz != tc.speed.KHz() {
+			t.Errorf("ClockSpeedKHz() after SetClockSpeed(%d) = %d, %v", tc.kHz, kHz, err)
+		}
+	}
+}
+
+func TestClockSpeedOldFirmware(t *testing.T) {
+	// SWD_SET_FREQ came with V2 J22, the clock of an older probe is unknown
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	p.JTAGVersion = 21
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+	if kHz, err := dev.ClockSpeedKHz(); err == nil {
+		t.Errorf("ClockSpeedKHz() = %d on firmware without SWD_SET_FREQ", kHz)
+	}
+	if err := dev.SetClockSpeed(4000); err == nil {
+		t.Error("SetClockSpeed() succeeded on firmware without SWD_SET_FREQ")
+	}
+}
+
+func TestJTAG(t *testing.T) {
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("", stlink.OpenOptions{Interface: stlink.DebugInterfaceJTAG})
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+
+	if dev.Interface() != stlink.DebugInterfaceJTAG || p.Interface != stlink.DebugInterfaceJTAG {
+		t.Fatalf("interface %s, probe in %s", dev.Interface(), p.Interface)
+	}
+	if _, err := dev.ClockSpeedKHz(); err == nil {
+		t.Error("JTAG clock speed known before it is set")
+	}
+	if err := dev.SetClockSpeed(5000); err != nil {
+		t.Fatalf("SetClockSpeed: %v", err)
+	}
+	if kHz, err := dev.ClockSpeedKHz(); err != nil || kHz != 4500 || p.ClockDivider != 8 {
+		t.Errorf("ClockSpeedKHz() = %d, %v; divider %d", kHz, err, p.ClockDivider)
+	}
+	if _, err := dev.ClockSpeed(); err == nil {
+		t.Error("ClockSpeed() returned an SWD divider for JTAG")
+	}
+	if v, err := dev.Read32(0xe000ed00); err != nil || v != 0x411fc231 {
+		t.Errorf("CPUID over JTAG = %08x, %v", v, err)
+	}
+}
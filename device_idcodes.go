@@ -6,19 +6,32 @@ import (
 )
 
 func (d *Device) CoreID() (uint32, error) {
+	if d.caps.Has(CapabilityAPIV3) {
+		return d.readIDCodes()
+	}
 	tx := make([]byte, cmdSize, cmdSize)
 	tx[0] = byte(stlinkCmdDebug)
 	tx[1] = byte(stlinkCmdDebugReadCoreid)
-	err := d.write(tx)
+	rx, err := d.command(tx, 4)
 	if err != nil {
 		return 0, err
 	}
+	return binary.LittleEndian.Uint32(rx), nil
+}
 
-	var v uint32
-	if err := binary.Read(d.inEp, binary.LittleEndian, &v); err != nil {
+// readIDCodes reads the debug port IDCODE with the API v2 command
+func (d *Device) readIDCodes() (uint32, error) {
+	if err := d.require(CapabilityAPIV2); err != nil {
+		return 0, err
+	}
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugAPIV2ReadIDCodes)
+	rx, err := d.commandStatus(tx, 12)
+	if err != nil {
 		return 0, err
 	}
-	return v, nil
+	return binary.LittleEndian.Uint32(rx[4:]), nil
 }
 
 const (
@@ -42,7 +55,9 @@ const cortexMCpuIDRegisterAddress uint32 = 0xE000ED00
 func (d *Device) CpuID() (uint32, error) {
 	id, err := d.Read32(cortexMCpuIDRegisterAddress)
 	if err == nil {
+		d.mu.Lock()
 		d.cpuID = id
+		d.mu.Unlock()
 	}
 	return id, err
 }
@@ -116,7 +131,7 @@ func (cf ChipFamily) Group() ChipFamilyGroup {
 		ChipFamilySTM32F04, ChipFamilySTM32F09X:
 		return ChipFamilyGroupSTM32F0
 	case ChipFamilySTM32F1Connectivity, ChipFamilySTM32F1High, ChipFamilySTM32F1Low,
-	ChipFamilySTM32F1Medium, ChipFamilySTM32F1VLHigh, ChipFamilySTM32F1VLMedium, ChipFamilySTM32F1XL:
+		ChipFamilySTM32F1Medium, ChipFamilySTM32F1VLHigh, ChipFamilySTM32F1VLMedium, ChipFamilySTM32F1XL:
 		return ChipFamilyGroupSTM32F1
 	case ChipFamilySTM32F2:
 		return ChipFamilyGroupSTM32F2
@@ -178,9 +193,20 @@ func (d *Device) FlashSize() (uint16, error) {
 	case ChipFamilySTM32L1MediumLow, ChipFamilySTM32L1Cat2:
 		return d.Read16(0x1ff8004c)
 
-	case ChipFamilySTM32L1MediumHigh, ChipFamilySTM32L1High, ChipFamilySTM32L152RE:
+	case ChipFamilySTM32L1MediumHigh, ChipFamilySTM32L152RE:
 		return d.Read16(0x1ff800cc)
 
+	case ChipFamilySTM32L1High:
+		// Cat.4 parts only tell 0 for 256KB and 1 for 384KB
+		sz, err := d.Read16(0x1ff800cc)
+		if err != nil {
+			return 0, err
+		}
+		if sz&1 != 0 {
+			return 384, nil
+		}
+		return 256, nil
+
 	case ChipFamilySTM32F7, ChipFamilySTM32F7Advanced:
 		return d.Read16(0x1ff0f442)
 
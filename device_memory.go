@@ -0,0 +1,182 @@
+package stlink
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// maxRW32 is the maximum size of a single 32-bit transfer, it is also
+// the auto-increment boundary of the access port which a single
+// transfer may not cross
+const maxRW32 = 1024
+
+// ReadMem reads len(buf) bytes of target memory starting at addr. The read
+// is split in 32-bit transfers for the aligned part and 8-bit transfers
+// for an unaligned head or tail.
+func (d *Device) ReadMem(addr uint32, buf []byte) error {
+	for len(buf) > 0 {
+		var n int
+		var err error
+		if addr%4 != 0 || len(buf) < 4 {
+			n = len(buf)
+			if addr%4 != 0 && n > int(4-addr%4) {
+				n = int(4 - addr%4)
+			}
+			err = d.readMem8(addr, buf[:n])
+		} else {
+			n = len(buf) &^ 3
+			if n > int(maxRW32-addr%maxRW32) {
+				n = int(maxRW32 - addr%maxRW32)
+			}
+			err = d.readMem32(addr, buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+		addr += uint32(n)
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func (d *Device) readMem(cmd stlinkCmd, addr uint32, buf []byte) error {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(cmd)
+	binary.LittleEndian.PutUint32(tx[2:], addr)
+	binary.LittleEndian.PutUint16(tx[6:], uint16(len(buf)))
+	n := len(buf)
+	// The ST-link always returns at least 2 bytes
+	if n == 1 {
+		n = 2
+	}
+	// The transfer and its status are one transaction
+	return d.transaction(func() error {
+		rx, err := d.exchange(tx, n)
+		if err != nil {
+			return err
+		}
+		copy(buf, rx)
+		return d.lastRWStatus(addr)
+	})
+}
+
+func (d *Device) readMem8(addr uint32, buf []byte) error {
+	return d.readMem(stlinkCmdDebugReadMem8, addr, buf)
+}
+
+func (d *Device) readMem32(addr uint32, buf []byte) error {
+	return d.readMem(stlinkCmdDebugReadMem32, addr, buf)
+}
+
+// WriteMem writes data to target memory starting at addr. The write is
+// split in 32-bit transfers for the aligned part and 8-bit transfers
+// for an unaligned head or tail, which are at most 3 bytes. A running
+// core is halted once for the whole write.
+func (d *Device) WriteMem(addr uint32, data []byte) (err error) {
+	resume, err := d.haltTemporarily()
+	if err != nil {
+		return err
+	}
+	defer resume(&err)
+	for len(data) > 0 {
+		var n int
+		if addr%4 != 0 || len(data) < 4 {
+			n = len(data)
+			if addr%4 != 0 && n > int(4-addr%4) {
+				n = int(4 - addr%4)
+			}
+			err = d.writeMem8(addr, data[:n])
+		} else {
+			n = len(data) &^ 3
+			if n > int(maxRW32-addr%maxRW32) {
+				n = int(maxRW32 - addr%maxRW32)
+			}
+			err = d.writeMem32(addr, data[:n])
+		}
+		if err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (d *Device) writeMem(cmd stlinkCmd, addr uint32, data []byte) error {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(cmd)
+	binary.LittleEndian.PutUint32(tx[2:], addr)
+	binary.LittleEndian.PutUint16(tx[6:], uint16(len(data)))
+	return d.transaction(func() error {
+		err := d.write(tx)
+		if err != nil {
+			return err
+		}
+		err = d.writeData(data)
+		if err != nil {
+			return err
+		}
+		return d.lastRWStatus(addr)
+	})
+}
+
+// lastRWStatus fetches the status of the last memory transfer, which
+// started at addr. A transfer itself has no status, so a bus fault is
+// only seen here. It is part of the transaction of the transfer.
+func (d *Device) lastRWStatus(addr uint32) error {
+	if !d.caps.Has(CapabilityAPIV2) {
+		return nil
+	}
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugGetLastRWStatus)
+	n := 2
+	if d.caps.Has(CapabilityLastRWStatus2) {
+		tx[1] = byte(stlinkCmdDebugGetLastRWStatus2)
+		n = 12
+	}
+	rx, err := d.exchange(tx, n)
+	if err != nil {
+		return err
+	}
+	if err := statusError(rx[0]); err != nil {
+		if n == 12 {
+			addr = binary.LittleEndian.Uint32(rx[4:])
+		}
+		return &MemoryError{Addr: addr, Err: err}
+	}
+	return nil
+}
+
+func (d *Device) writeMem8(addr uint32, data []byte) error {
+	return d.writeMem(stlinkCmdDebugWriteMem8, addr, data)
+}
+
+func (d *Device) writeMem32(addr uint32, data []byte) error {
+	return d.writeMem(stlinkCmdDebugWriteMem32, addr, data)
+}
+
+// writeMem16 writes data to target memory at addr in 16-bit accesses,
+// which the flash of some chips needs. addr and len(data) are even.
+func (d *Device) writeMem16(addr uint32, data []byte) error {
+	if err := d.require(CapabilityMem16); err != nil {
+		return err
+	}
+	if addr%2 != 0 || len(data)%2 != 0 {
+		return errors.New("unaligned 16-bit write")
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > int(maxRW32-addr%maxRW32) {
+			n = int(maxRW32 - addr%maxRW32)
+		}
+		if err := d.writeMem(stlinkCmdDebugWriteMem16, addr, data[:n]); err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
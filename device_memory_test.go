@@ -0,0 +1,71 @@
+package stlink_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+// memoryTests are transfers which are split in different ways
+var memoryTests = []struct {
+	name string
+	addr uint32
+	n    int
+}{
+	{"aligned", 0x20000000, 64},
+	{"unaligned head", 0x20000101, 15},
+	{"unaligned tail", 0x20000200, 7},
+	{"short", 0x20000302, 1},
+	// a 3 byte head, 1KB split at 0x20000800 and a 2 byte tail
+	{"1KB boundary", 0x200007fd, 3 + 2048 + 2},
+}
+
+// targetBytes reads n bytes of simulated target memory at addr
+func targetBytes(t *sim.Target, addr uint32, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(t.Read(addr+uint32(i), 1))
+	}
+	return b
+}
+
+func TestReadMem(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	for i, tc := range memoryTests {
+		data := make([]byte, tc.n)
+		for j := range data {
+			data[j] = byte(j*7 + i + 1)
+			p.Target.Write(tc.addr+uint32(j), 1, uint32(data[j]))
+		}
+		buf := make([]byte, tc.n)
+		if err := dev.ReadMem(tc.addr, buf); err != nil || !bytes.Equal(buf, data) {
+			t.Errorf("%s: ReadMem differs from the target memory: %v", tc.name, err)
+		}
+	}
+}
+
+func TestWriteMem(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	for i, tc := range memoryTests {
+		data := make([]byte, tc.n)
+		for j := range data {
+			data[j] = byte(j*5 + i + 1)
+		}
+		if err := dev.WriteMem(tc.addr, data); err != nil {
+			t.Fatalf("%s: WriteMem: %v", tc.name, err)
+		}
+		if got := targetBytes(p.Target, tc.addr-1, tc.n+2); got[0] != 0 || got[tc.n+1] != 0 ||
+			!bytes.Equal(got[1:tc.n+1], data) {
+			t.Errorf("%s: target memory differs from the write", tc.name)
+		}
+		buf := make([]byte, tc.n)
+		if err := dev.ReadMem(tc.addr, buf); err != nil || !bytes.Equal(buf, data) {
+			t.Errorf("%s: ReadMem differs from the write: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package stlink
+
+import (
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+func TestProbeName(t *testing.T) {
+	tests := []struct {
+		pid  gousb.ID
+		name string
+	}{
+		{0x3744, "ST-link V1"},
+		{0x3748, "ST-link V2"},
+		{0x374b, "ST-link V2-1"},
+		{0x3752, "ST-link V2-1 (no MSD)"},
+		{0x374e, "STLINK-V3E"},
+		{0x374f, "STLINK-V3"},
+		{0x3753, "STLINK-V3 (2 VCP)"},
+		{0x3754, "STLINK-V3 (no MSD)"},
+		{0x3757, "STLINK-V3PWR"},
+	}
+	for _, tc := range tests {
+		name, err := probeName(tc.pid)
+		if err != nil || name != tc.name {
+			t.Errorf("probeName(%04x) = %q, %v; want %q", uint16(tc.pid), name, err, tc.name)
+		}
+		if !supportedPID(tc.pid) {
+			t.Errorf("PID %04x not supported", uint16(tc.pid))
+		}
+	}
+	if _, err := probeName(0x3749); err == nil {
+		t.Error("probeName of an unknown PID succeeded")
+	}
+}
@@ -0,0 +1,145 @@
+package stlink
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReconnectEvent describes an attempt to recover the connection of a
+// device, it is passed to OpenOptions.OnReconnect
+type ReconnectEvent struct {
+	// Cause is the error which showed the connection was lost, nil for
+	// a call to Reconnect
+	Cause error
+	// Err is the reason the reconnect failed, nil on success
+	Err error
+}
+
+// connectionLost reports whether err means the probe is gone or the
+// target dropped its debug connection
+func connectionLost(err error) bool {
+	return errors.Is(err, ErrDisconnected) ||
+		errors.Is(err, ErrSWDDPError) ||
+		errors.Is(err, ErrSWDDPFault) ||
+		errors.Is(err, ErrSWDDPParity)
+}
+
+// transaction runs f, which does a single command and reads its
+// response, with d.mu held. When the connection is lost while doing so
+// and OpenOptions.AutoReconnect is set, the device reconnects and runs f
+// once more.
+func (d *Device) transaction(f func() error) error {
+	d.mu.Lock()
+	err := f()
+	retry := err != nil && d.opts.AutoReconnect && !d.reconnecting && connectionLost(err)
+	generation := d.generation
+	d.mu.Unlock()
+	if !retry {
+		return err
+	}
+	if d.reconnect(err, generation) != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return f()
+}
+
+// Reconnect re-opens the probe and reconnects to the target. The debug
+// interface and clock speed are restored and a halted core is halted
+// again. A closed device can't be reconnected.
+func (d *Device) Reconnect() error {
+	d.mu.Lock()
+	generation, opened := d.generation, d.opened
+	d.mu.Unlock()
+	if !opened {
+		return errors.New("device closed")
+	}
+	return d.reconnect(nil, generation)
+}
+
+// reconnect recovers from the loss of the connection, unless another
+// goroutine did so already since generation
+func (d *Device) reconnect(cause error, generation uint) error {
+	d.reconnectMu.Lock()
+	defer d.reconnectMu.Unlock()
+
+	d.mu.Lock()
+	if d.generation != generation {
+		d.mu.Unlock()
+		return nil
+	}
+	d.reconnecting = true
+	state, clock, iface := d.coreState, d.clockKHz, d.iface
+	d.mu.Unlock()
+
+	err := d.restore(cause, state, clock, iface)
+
+	d.mu.Lock()
+	d.reconnecting = false
+	d.generation++
+	d.mu.Unlock()
+	if d.opts.OnReconnect != nil {
+		d.opts.OnReconnect(ReconnectEvent{Cause: cause, Err: err})
+	}
+	return err
+}
+
+func (d *Device) restore(cause error, state StlinkStatus, clock uint, iface DebugInterface) error {
+	// Only a probe which is gone is reopened, the target is reconnected
+	// over the existing connection otherwise
+	if cause == nil || errors.Is(cause, ErrDisconnected) {
+		if d.reopen == nil {
+			if cause != nil {
+				return errors.New("device can't be reopened")
+			}
+		} else if err := d.reopenTransport(); err != nil {
+			return err
+		}
+	}
+
+	opts := d.opts
+	opts.Interface = iface
+	if err := d.connect(opts); err != nil {
+		return err
+	}
+	if cur, err := d.ClockSpeedKHz(); clock != 0 && (err != nil || cur != clock) {
+		if err := d.SetClockSpeed(clock); err != nil {
+			return fmt.Errorf("restore clock speed: %w", err)
+		}
+	}
+	if state == StlinkStatusCoreHalted {
+		if err := d.Halt(); err != nil {
+			return fmt.Errorf("restore halt state: %w", err)
+		}
+	}
+	return nil
+}
+
+// reopenTransport replaces the transport by a new one to the same probe,
+// until that succeeds every command fails with ErrDisconnected
+func (d *Device) reopenTransport() error {
+	d.mu.Lock()
+	old := d.tr
+	d.lost = true
+	d.mu.Unlock()
+	// The probe is gone, an error closing it says nothing new
+	old.Close()
+
+	t, err := d.reopen()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if !d.opened {
+		// closed meanwhile, nothing would close t
+		d.mu.Unlock()
+		t.Close()
+		return errors.New("device closed")
+	}
+	d.tr = t
+	d.lost = false
+	d.resync = false
+	d.mu.Unlock()
+	return nil
+}
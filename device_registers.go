@@ -0,0 +1,380 @@
+package stlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// CoreRegister identifies a core register, the value is the register
+// selector of the Cortex-M DCRSR register
+type CoreRegister uint8
+
+const (
+	CoreRegisterR0    CoreRegister = 0x00
+	CoreRegisterR1    CoreRegister = 0x01
+	CoreRegisterR2    CoreRegister = 0x02
+	CoreRegisterR3    CoreRegister = 0x03
+	CoreRegisterR4    CoreRegister = 0x04
+	CoreRegisterR5    CoreRegister = 0x05
+	CoreRegisterR6    CoreRegister = 0x06
+	CoreRegisterR7    CoreRegister = 0x07
+	CoreRegisterR8    CoreRegister = 0x08
+	CoreRegisterR9    CoreRegister = 0x09
+	CoreRegisterR10   CoreRegister = 0x0a
+	CoreRegisterR11   CoreRegister = 0x0b
+	CoreRegisterR12   CoreRegister = 0x0c
+	CoreRegisterSP    CoreRegister = 0x0d
+	CoreRegisterLR    CoreRegister = 0x0e
+	CoreRegisterPC    CoreRegister = 0x0f
+	CoreRegisterXPSR  CoreRegister = 0x10
+	CoreRegisterMSP   CoreRegister = 0x11
+	CoreRegisterPSP   CoreRegister = 0x12
+	CoreRegisterFPSCR CoreRegister = 0x21
+	CoreRegisterS0    CoreRegister = 0x40
+	CoreRegisterS31   CoreRegister = 0x5f
+
+	// coreRegisterSpecial holds CONTROL, FAULTMASK, BASEPRI and PRIMASK,
+	// one per byte
+	coreRegisterSpecial CoreRegister = 0x14
+
+	// The registers packed in coreRegisterSpecial, the low bits are
+	// the byte index
+	CoreRegisterPRIMASK   CoreRegister = 0x80
+	CoreRegisterBASEPRI   CoreRegister = 0x81
+	CoreRegisterFAULTMASK CoreRegister = 0x82
+	CoreRegisterCONTROL   CoreRegister = 0x83
+)
+
+func (r CoreRegister) String() string {
+	switch {
+	case r <= CoreRegisterR12:
+		return fmt.Sprintf("r%d", r)
+	case r >= CoreRegisterS0 && r <= CoreRegisterS31:
+		return fmt.Sprintf("s%d", r-CoreRegisterS0)
+	}
+	switch r {
+	case CoreRegisterSP:
+		return "sp"
+	case CoreRegisterLR:
+		return "lr"
+	case CoreRegisterPC:
+		return "pc"
+	case CoreRegisterXPSR:
+		return "xpsr"
+	case CoreRegisterMSP:
+		return "msp"
+	case CoreRegisterPSP:
+		return "psp"
+	case CoreRegisterFPSCR:
+		return "fpscr"
+	case CoreRegisterPRIMASK:
+		return "primask"
+	case CoreRegisterBASEPRI:
+		return "basepri"
+	case CoreRegisterFAULTMASK:
+		return "faultmask"
+	case CoreRegisterCONTROL:
+		return "control"
+	}
+	return "unknown"
+}
+
+func (r CoreRegister) packed() bool {
+	return r >= CoreRegisterPRIMASK && r <= CoreRegisterCONTROL
+}
+
+func (r CoreRegister) fp() bool {
+	return r == CoreRegisterFPSCR || (r >= CoreRegisterS0 && r <= CoreRegisterS31)
+}
+
+// CoreRegisterSet returns the registers of a core with part number pn,
+// fpu selects the floating point registers of a Cortex-M4F/M7
+func CoreRegisterSet(pn CortexMPartNumber, fpu bool) []CoreRegister {
+	var set []CoreRegister
+	for r := CoreRegisterR0; r <= CoreRegisterPSP; r++ {
+		set = append(set, r)
+	}
+	switch pn {
+	case CortexMPartNumberM0, CortexMPartNumberM0Plus, CortexMPartNumberM1:
+		// ARMv6-M has no BASEPRI and FAULTMASK
+		return append(set, CoreRegisterPRIMASK, CoreRegisterCONTROL)
+	}
+	set = append(set, CoreRegisterPRIMASK, CoreRegisterBASEPRI,
+		CoreRegisterFAULTMASK, CoreRegisterCONTROL)
+	if fpu && (pn == CortexMPartNumberM4 || pn == CortexMPartNumberM7) {
+		for r := CoreRegisterS0; r <= CoreRegisterS31; r++ {
+			set = append(set, r)
+		}
+		set = append(set, CoreRegisterFPSCR)
+	}
+	return set
+}
+
+// CoreRegisters is a snapshot of the core registers of the target
+type CoreRegisters struct {
+	// Set lists the registers of this core
+	Set []CoreRegister
+
+	R                                    [13]uint32
+	SP, LR, PC, XPSR, MSP, PSP           uint32
+	PRIMASK, BASEPRI, FAULTMASK, CONTROL uint8
+	S                                    [32]uint32
+	FPSCR                                uint32
+}
+
+func (c *CoreRegisters) field(r CoreRegister) *uint32 {
+	switch {
+	case r <= CoreRegisterR12:
+		return &c.R[r]
+	case r >= CoreRegisterS0 && r <= CoreRegisterS31:
+		return &c.S[r-CoreRegisterS0]
+	}
+	switch r {
+	case CoreRegisterSP:
+		return &c.SP
+	case CoreRegisterLR:
+		return &c.LR
+	case CoreRegisterPC:
+		return &c.PC
+	case CoreRegisterXPSR:
+		return &c.XPSR
+	case CoreRegisterMSP:
+		return &c.MSP
+	case CoreRegisterPSP:
+		return &c.PSP
+	case CoreRegisterFPSCR:
+		return &c.FPSCR
+	}
+	return nil
+}
+
+// Get returns the value of register r
+func (c *CoreRegisters) Get(r CoreRegister) uint32 {
+	switch r {
+	case CoreRegisterPRIMASK:
+		return uint32(c.PRIMASK)
+	case CoreRegisterBASEPRI:
+		return uint32(c.BASEPRI)
+	case CoreRegisterFAULTMASK:
+		return uint32(c.FAULTMASK)
+	case CoreRegisterCONTROL:
+		return uint32(c.CONTROL)
+	}
+	if f := c.field(r); f != nil {
+		return *f
+	}
+	return 0
+}
+
+func (c *CoreRegisters) setSpecial(v uint32) {
+	c.PRIMASK = uint8(v)
+	c.BASEPRI = uint8(v >> 8)
+	c.FAULTMASK = uint8(v >> 16)
+	c.CONTROL = uint8(v >> 24)
+}
+
+// HasFPU reports whether the core has a floating point unit
+func (d *Device) HasFPU() (bool, error) {
+	pn, err := d.CortexMPartNumber()
+	if err != nil {
+		return false, err
+	}
+	if pn != CortexMPartNumberM4 && pn != CortexMPartNumberM7 {
+		return false, nil
+	}
+	mvfr0, err := d.Read32(MVFR0Reg)
+	if err != nil {
+		return false, err
+	}
+	return mvfr0 != 0, nil
+}
+
+// ReadRegister reads a core register, the core is halted when needed
+func (d *Device) ReadRegister(r CoreRegister) (_ uint32, err error) {
+	resume, err := d.haltTemporarily()
+	if err != nil {
+		return 0, err
+	}
+	defer resume(&err)
+	switch {
+	case r.packed():
+		v, err := d.readReg(coreRegisterSpecial)
+		return (v >> (8 * uint(r&3))) & 0xff, err
+	case r.fp():
+		return d.readDCRSR(r)
+	}
+	return d.readReg(r)
+}
+
+// WriteRegister writes a core register, the core is halted when needed
+func (d *Device) WriteRegister(r CoreRegister, v uint32) (err error) {
+	resume, err := d.haltTemporarily()
+	if err != nil {
+		return err
+	}
+	defer resume(&err)
+	switch {
+	case r.packed():
+		d.dcrsrMu.Lock()
+		defer d.dcrsrMu.Unlock()
+		cur, err := d.readReg(coreRegisterSpecial)
+		if err != nil {
+			return err
+		}
+		shift := 8 * uint(r&3)
+		cur &^= 0xff << shift
+		cur |= (v & 0xff) << shift
+		return d.writeReg(coreRegisterSpecial, cur)
+	case r.fp():
+		return d.writeDCRSR(r, v)
+	}
+	return d.writeReg(r, v)
+}
+
+// ReadAllRegisters reads all core registers of the target, the set of
+// registers is chosen from the part number of the core
+func (d *Device) ReadAllRegisters() (_ *CoreRegisters, err error) {
+	pn, err := d.CortexMPartNumber()
+	if err != nil {
+		return nil, err
+	}
+	fpu, err := d.HasFPU()
+	if err != nil {
+		return nil, err
+	}
+
+	resume, err := d.haltTemporarily()
+	if err != nil {
+		return nil, err
+	}
+	defer resume(&err)
+
+	regs := &CoreRegisters{
+		Set: CoreRegisterSet(pn, fpu),
+	}
+
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugReadallregs)
+	// r0-r15, xpsr, msp, psp and two reserved words, the API v2
+	// precedes them with a status word
+	n, off := 84, 0
+	if d.caps.Has(CapabilityAPIV2) {
+		tx[1] = byte(stlinkCmdDebugReadcoreregs)
+		n, off = 88, 4
+	}
+	rx, err := d.command(tx, n)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 {
+		if err := statusError(rx[0]); err != nil {
+			return nil, err
+		}
+	}
+	for r := CoreRegisterR0; r <= CoreRegisterPSP; r++ {
+		*regs.field(r) = binary.LittleEndian.Uint32(rx[off+4*int(r):])
+	}
+
+	special, err := d.readReg(coreRegisterSpecial)
+	if err != nil {
+		return nil, err
+	}
+	regs.setSpecial(special)
+
+	if fpu {
+		for r := CoreRegisterS0; r <= CoreRegisterS31; r++ {
+			if regs.S[r-CoreRegisterS0], err = d.readDCRSR(r); err != nil {
+				return nil, err
+			}
+		}
+		if regs.FPSCR, err = d.readDCRSR(CoreRegisterFPSCR); err != nil {
+			return nil, err
+		}
+	}
+	return regs, nil
+}
+
+func (d *Device) readReg(r CoreRegister) (uint32, error) {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	tx[1] = byte(stlinkCmdDebugReadReg)
+	tx[2] = byte(r)
+	if !d.caps.Has(CapabilityAPIV2) {
+		// The API v1 returns the bare value
+		tx[1] = byte(stlinkCmdDebugAPIV1ReadReg)
+		rx, err := d.command(tx, 4)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(rx), nil
+	}
+	rx, err := d.commandStatus(tx, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(rx[4:]), nil
+}
+
+func (d *Device) writeReg(r CoreRegister, v uint32) error {
+	tx := make([]byte, cmdSize, cmdSize)
+	tx[0] = byte(stlinkCmdDebug)
+	switch {
+	case !d.caps.Has(CapabilityAPIV2):
+		tx[1] = byte(stlinkCmdDebugAPIV1WriteReg)
+	case r == CoreRegisterPC:
+		tx[1] = byte(stlinkCmdDebugWriteRegpc)
+	default:
+		tx[1] = byte(stlinkCmdDebugWriteReg)
+	}
+	tx[2] = byte(r)
+	binary.LittleEndian.PutUint32(tx[3:], v)
+	_, err := d.commandStatus(tx, 2)
+	return err
+}
+
+// dcrsrTimeout bounds the wait for a register transfer through DCRSR
+const dcrsrTimeout = 100 * time.Millisecond
+
+func (d *Device) waitRegReady() error {
+	deadline := time.Now().Add(dcrsrTimeout)
+	for {
+		v, err := d.Read32(DHCSRReg)
+		if err != nil {
+			return err
+		}
+		if v&DHCSRStatusRegReadyBit != 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &TimeoutError{Op: "register transfer", Duration: dcrsrTimeout}
+		}
+	}
+}
+
+// readDCRSR reads a register through the DCRSR/DCRDR registers, the
+// ST-link has no commands for the floating point registers
+func (d *Device) readDCRSR(r CoreRegister) (uint32, error) {
+	d.dcrsrMu.Lock()
+	defer d.dcrsrMu.Unlock()
+	if err := d.writeDebug32(DCRSRReg, uint32(r)); err != nil {
+		return 0, err
+	}
+	if err := d.waitRegReady(); err != nil {
+		return 0, err
+	}
+	return d.Read32(DCRDRReg)
+}
+
+func (d *Device) writeDCRSR(r CoreRegister, v uint32) error {
+	d.dcrsrMu.Lock()
+	defer d.dcrsrMu.Unlock()
+	if err := d.writeDebug32(DCRDRReg, v); err != nil {
+		return err
+	}
+	if err := d.writeDebug32(DCRSRReg, uint32(r)|DCRSRRegWriteBit); err != nil {
+		return err
+	}
+	return d.waitRegReady()
+}
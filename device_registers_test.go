@@ -0,0 +1,110 @@
+package stlink_test
+
+import (
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestRegisters(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe func(*sim.Target) *sim.Probe
+	}{
+		{"API v1", func(t *sim.Target) *sim.Probe { return sim.NewProbeV1("v1", 10, t) }},
+		{"API v2", func(t *sim.Target) *sim.Probe { return sim.NewProbe("v2", t) }},
+	}
+	for _, tc := range tests {
+		p := tc.probe(sim.NewTarget(sim.STM32F407xG))
+		dev, err := stlink.NewWithBackend(sim.NewBus(p)).OpenDevice("")
+		if err != nil {
+			t.Fatalf("%s: OpenDevice: %v", tc.name, err)
+		}
+		if dev.Capabilities().Has(stlink.CapabilityAPIV2) != (tc.name == "API v2") {
+			t.Fatalf("%s: capabilities %s", tc.name, dev.Capabilities())
+		}
+		regs := &p.Target.Regs
+		for i := range regs {
+			regs[i] = 0x1000 + uint32(i)
+		}
+		// CONTROL, FAULTMASK, BASEPRI and PRIMASK
+		regs[0x14] = 0x02010801
+
+		for _, r := range []struct {
+			reg  stlink.CoreRegister
+			want uint32
+		}{
+			{stlink.CoreRegisterR3, 0x1003},
+			{stlink.CoreRegisterPC, 0x100f},
+			{stlink.CoreRegisterPSP, 0x1012},
+			{stlink.CoreRegisterPRIMASK, 0x01},
+			{stlink.CoreRegisterBASEPRI, 0x08},
+			{stlink.CoreRegisterCONTROL, 0x02},
+			{stlink.CoreRegisterS0 + 5, 0x1045},
+			{stlink.CoreRegisterFPSCR, 0x1021},
+		} {
+			if v, err := dev.ReadRegister(r.reg); err != nil || v != r.want {
+				t.Errorf("%s: ReadRegister(%s) = %#x, %v; want %#x", tc.name, r.reg, v, err, r.want)
+			}
+		}
+
+		writes := []struct {
+			reg stlink.CoreRegister
+			v   uint32
+		}{
+			{stlink.CoreRegisterR7, 0xdeadbeef},
+			{stlink.CoreRegisterPC, 0x08000101},
+			{stlink.CoreRegisterBASEPRI, 0x40},
+			{stlink.CoreRegisterS0 + 31, 0x3f800000},
+			{stlink.CoreRegisterFPSCR, 0x03000000},
+		}
+		for _, w := range writes {
+			if err := dev.WriteRegister(w.reg, w.v); err != nil {
+				t.Errorf("%s: WriteRegister(%s): %v", tc.name, w.reg, err)
+			}
+		}
+		if regs[0x07] != 0xdeadbeef || regs[0x0f] != 0x08000101 || regs[0x5f] != 0x3f800000 || regs[0x21] != 0x03000000 {
+			t.Errorf("%s: registers after writes: r7 %#x, pc %#x, s31 %#x, fpscr %#x",
+				tc.name, regs[0x07], regs[0x0f], regs[0x5f], regs[0x21])
+		}
+		if regs[0x14] != 0x02014001 {
+			t.Errorf("%s: special registers %08x after writing BASEPRI", tc.name, regs[0x14])
+		}
+
+		all, err := dev.ReadAllRegisters()
+		if err != nil {
+			t.Fatalf("%s: ReadAllRegisters: %v", tc.name, err)
+		}
+		want := stlink.CoreRegisterSet(stlink.CortexMPartNumberM4, true)
+		if len(all.Set) != len(want) || len(all.Set) != 19+4+33 {
+			t.Errorf("%s: register set of %d registers", tc.name, len(all.Set))
+		}
+		if all.R[7] != 0xdeadbeef || all.PC != 0x08000101 || all.XPSR != 0x1010 || all.MSP != 0x1011 {
+			t.Errorf("%s: ReadAllRegisters r7 %#x, pc %#x, xpsr %#x, msp %#x", tc.name, all.R[7], all.PC, all.XPSR, all.MSP)
+		}
+		if all.PRIMASK != 0x01 || all.BASEPRI != 0x40 || all.FAULTMASK != 0x01 || all.CONTROL != 0x02 {
+			t.Errorf("%s: ReadAllRegisters special %+v", tc.name, all)
+		}
+		if all.S[31] != 0x3f800000 || all.S[4] != 0x1044 || all.FPSCR != 0x03000000 {
+			t.Errorf("%s: ReadAllRegisters s31 %#x, s4 %#x, fpscr %#x", tc.name, all.S[31], all.S[4], all.FPSCR)
+		}
+		for _, r := range all.Set {
+			if r == stlink.CoreRegisterR7 && all.Get(r) != 0xdeadbeef {
+				t.Errorf("%s: Get(r7) = %#x", tc.name, all.Get(r))
+			}
+		}
+		dev.Close()
+	}
+
+	// ARMv6-M has no FP, BASEPRI and FAULTMASK
+	dev, _ := openSim(t, sim.STM32F072xB)
+	defer dev.Close()
+	all, err := dev.ReadAllRegisters()
+	if err != nil {
+		t.Fatalf("ReadAllRegisters on a Cortex-M0: %v", err)
+	}
+	if len(all.Set) != 19+2 {
+		t.Errorf("Cortex-M0 register set %v", all.Set)
+	}
+}
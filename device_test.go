@@ -0,0 +1,444 @@
+package stlink_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func openSim(t *testing.T, cfg sim.TargetConfig) (*stlink.Device, *sim.Probe) {
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(cfg))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	return dev, p
+}
+
+func TestProbe(t *testing.T) {
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	devs, err := s.Probe()
+	if err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if len(devs) != 1 || devs[0].SerialNumber != "0123456789ab" || devs[0].PID != stlink.StlinkV2PID {
+		t.Fatalf("unexpected probe result: %+v", devs)
+	}
+	d := devs[0]
+	if d.Path != "1-1" || d.Manufacturer != "STMicroelectronics" || d.Product != "STM32 STLink" {
+		t.Errorf("descriptor = %q %q %q", d.Path, d.Manufacturer, d.Product)
+	}
+	if p.Mode != stlink.StlinkModeDfu {
+		t.Errorf("Probe changed the probe mode to %s", p.Mode)
+	}
+
+	// firmware and voltage are read on demand, not while the probe is
+	// in use
+	fw, voltage, err := d.QueryProbe()
+	if err != nil || fw.String() != "V2J28S7" || voltage < 3.2 || voltage > 3.4 {
+		t.Errorf("QueryProbe() = %s, %.3f, %v", fw, voltage, err)
+	}
+	if p.Mode != stlink.StlinkModeDfu {
+		t.Errorf("QueryProbe changed the probe mode to %s", p.Mode)
+	}
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	if _, _, err := d.QueryProbe(); err == nil {
+		t.Error("QueryProbe() of a probe in use succeeded")
+	}
+	if fw, _, err := dev.QueryProbe(); err != nil || fw.String() != "V2J28S7" {
+		t.Errorf("QueryProbe() of the opened device = %s, %v", fw, err)
+	}
+	dev.Close()
+	if _, err := s.OpenDevice("nonexistent"); err == nil {
+		t.Fatal("OpenDevice with unknown serial succeeded")
+	}
+}
+
+func TestOpenDeviceSelect(t *testing.T) {
+	// clones sharing a serial number
+	p1 := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	p2 := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F407xG))
+	p3 := sim.NewProbe("cafe", sim.NewTarget(sim.STM32F072xB))
+	s := stlink.NewWithBackend(sim.NewBus(p1, p2, p3))
+
+	var amb *stlink.AmbiguousError
+	if _, err := s.OpenDevice("0123456789ab"); !errors.As(err, &amb) || len(amb.Probes) != 2 {
+		t.Fatalf("OpenDevice with shared serial: %v", err)
+	}
+	if _, err := s.OpenDevice(""); !errors.As(err, &amb) || len(amb.Probes) != 3 {
+		t.Fatalf("OpenDevice of any probe: %v", err)
+	}
+	if _, err := s.OpenDevice("", stlink.OpenOptions{Path: "1-9"}); !errors.Is(err, stlink.ErrDeviceNotFound) {
+		t.Errorf("OpenDevice with unknown path: %v", err)
+	}
+
+	zero, two := 0, 2
+	tests := []struct {
+		serial string
+		opts   stlink.OpenOptions
+		probe  *sim.Probe
+	}{
+		{"cafe", stlink.OpenOptions{}, p3},
+		{"0123456789ab", stlink.OpenOptions{Path: "1-2"}, p2},
+		{"", stlink.OpenOptions{Index: &two}, p3},
+		{"", stlink.OpenOptions{Index: &zero}, p1},
+		{"", stlink.OpenOptions{Match: func(p stlink.ProbeInfo) bool { return p.SerialNumber == "cafe" }}, p3},
+	}
+	for i, tc := range tests {
+		dev, err := s.OpenDevice(tc.serial, tc.opts)
+		if err != nil {
+			t.Errorf("%d: OpenDevice: %v", i, err)
+			continue
+		}
+		if dev.Path != tc.probe.Path || tc.probe.Mode != stlink.StlinkModeDebug {
+			t.Errorf("%d: opened %s, want %s", i, dev.Path, tc.probe.Path)
+		}
+		dev.Close()
+	}
+}
+
+func TestOpenDevice(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	if p.Mode != stlink.StlinkModeDebug {
+		t.Errorf("probe not in debug mode after open: %s", p.Mode)
+	}
+	if dev.SerialNumber != "0123456789ab" {
+		t.Errorf("serial = %q", dev.SerialNumber)
+	}
+	ver, err := dev.Version()
+	if err != nil || ver != "V2J28S7" {
+		t.Errorf("Version() = %q, %v", ver, err)
+	}
+	pv, err := dev.ProbeVersion()
+	if err != nil || pv.Stlink != 2 || pv.JTAG != 28 || pv.PID != stlink.StlinkV2PID {
+		t.Errorf("ProbeVersion() = %+v, %v", pv, err)
+	}
+	caps := dev.Capabilities()
+	if !caps.Has(stlink.CapabilitySWDFreq|stlink.CapabilityMultiAP) || caps.Has(stlink.CapabilityAPIV3) {
+		t.Errorf("Capabilities() = %s", caps)
+	}
+	v, err := dev.TargetVoltage()
+	if err != nil || v < 3.29 || v > 3.31 {
+		t.Errorf("TargetVoltage() = %f, %v", v, err)
+	}
+}
+
+func TestDeviceIdentification(t *testing.T) {
+	tests := []struct {
+		cfg    sim.TargetConfig
+		pn     stlink.CortexMPartNumber
+		family stlink.ChipFamily
+	}{
+		{sim.STM32F103xB, stlink.CortexMPartNumberM3, stlink.ChipFamilySTM32F1Medium},
+		{sim.STM32F072xB, stlink.CortexMPartNumberM0, stlink.ChipFamilySTM32F0Can},
+		{sim.STM32F407xG, stlink.CortexMPartNumberM4, stlink.ChipFamilySTM32F4},
+	}
+	for _, tc := range tests {
+		dev, _ := openSim(t, tc.cfg)
+		pn, err := dev.CortexMPartNumber()
+		if err != nil || pn != tc.pn {
+			t.Errorf("CortexMPartNumber() = %s, %v; want %s", pn, err, tc.pn)
+		}
+		family, err := dev.DevID()
+		if err != nil || family != tc.family {
+			t.Errorf("DevID() = %03x, %v; want %03x", family, err, tc.family)
+		}
+		sz, err := dev.FlashSize()
+		if err != nil || sz != tc.cfg.FlashSize {
+			t.Errorf("FlashSize() = %d, %v; want %d", sz, err, tc.cfg.FlashSize)
+		}
+		dev.Close()
+	}
+}
+
+func TestDeviceString(t *testing.T) {
+	dev, _ := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+
+	s := dev.String()
+	for _, want := range []string{
+		"name:    ST-link V2\n",
+		"mode:    debug\n",
+		"version: V2J28S7\n",
+		"coreid:  1ba01477\n",
+		"cpu:     411fc231\n",
+		"dev:     410\n",
+		"part-no: ARM Cortex-M3\n",
+		"flash:   128\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String() misses %q, got:\n%s", want, s)
+		}
+	}
+}
+
+func TestOpenDeviceAPIV1(t *testing.T) {
+	p := sim.NewProbeV1("v1", 10, sim.NewTarget(sim.STM32F103xB))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+
+	caps := dev.Capabilities()
+	if caps.Has(stlink.CapabilityAPIV2) || caps.Has(stlink.CapabilityTrace) {
+		t.Errorf("Capabilities() = %s", caps)
+	}
+	// single words go through memory transfers
+	if err := dev.Write32(0x20000000, 0xdeadbeef); err != nil {
+		t.Fatalf("Write32: %v", err)
+	}
+	if v, err := dev.Read32(0x20000000); err != nil || v != 0xdeadbeef {
+		t.Errorf("Read32() = %08x, %v", v, err)
+	}
+	if err := dev.HardReset(); err == nil {
+		t.Error("HardReset succeeded on API v1 firmware")
+	}
+}
+
+func TestOpenDeviceV21(t *testing.T) {
+	p := sim.NewProbeV21("066dff000000", sim.NewTarget(sim.STM32F072xB))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+
+	pv, err := dev.ProbeVersion()
+	if err != nil || pv.Stlink != 2 || pv.JTAG != 37 || pv.MSD != 26 || pv.SWIM != 0 {
+		t.Errorf("ProbeVersion() = %+v, %v", pv, err)
+	}
+	if pv.String() != "V2J37M26" {
+		t.Errorf("version %s", pv)
+	}
+}
+
+func TestOpenDeviceV3(t *testing.T) {
+	p := sim.NewProbeV3("003f00000000", sim.NewTarget(sim.STM32F407xG))
+	s := stlink.NewWithBackend(sim.NewBus(p))
+	dev, err := s.OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+
+	name, err := dev.Name()
+	if err != nil || name != "STLINK-V3" {
+		t.Errorf("Name() = %q, %v", name, err)
+	}
+	ver, err := dev.Version()
+	if err != nil || ver != "V3J7M3B3S1" {
+		t.Errorf("Version() = %q, %v", ver, err)
+	}
+	id, err := dev.CoreID()
+	if err != nil || id != p.CoreID {
+		t.Errorf("CoreID() = %08x, %v", id, err)
+	}
+	if err := dev.SetClockSpeed(4000); err != nil {
+		t.Fatalf("SetClockSpeed: %v", err)
+	}
+	khz, err := dev.ClockSpeedKHz()
+	if err != nil || khz != 3300 || p.ClockKHz != 3300 {
+		t.Errorf("ClockSpeed() = %d, %v; probe at %d", khz, err, p.ClockKHz)
+	}
+	if err := dev.SetClockSpeed(1); err != nil || p.ClockKHz != 5 {
+		t.Errorf("SetClockSpeed(1): %v, probe at %d", err, p.ClockKHz)
+	}
+	if err := dev.Reset(); err != nil {
+		t.Errorf("Reset: %v", err)
+	}
+}
+
+func TestBusFault(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	p.Target.MapFault(0x60000000, 0x1000)
+
+	if _, err := dev.Read32(0x60000000); !errors.Is(err, stlink.ErrSWDAPFault) {
+		t.Errorf("Read32 of a faulting address: %v", err)
+	}
+	err := dev.ReadMem(0x5ffffff8, make([]byte, 16))
+	var merr *stlink.MemoryError
+	if !errors.As(err, &merr) || merr.Addr != 0x60000000 || !errors.Is(err, stlink.ErrSWDAPFault) {
+		t.Errorf("ReadMem over a faulting region: %v", err)
+	}
+	if err := dev.WriteMem(0x60000800, []byte{1, 2, 3, 4}); !errors.Is(err, stlink.ErrSWDAPFault) {
+		t.Errorf("WriteMem to a faulting region: %v", err)
+	}
+	if err := dev.ReadMem(0x20000000, make([]byte, 16)); err != nil {
+		t.Errorf("ReadMem of RAM: %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	dev.SetTimeout(20 * time.Millisecond)
+
+	p.Hang = true
+	start := time.Now()
+	if _, err := dev.Read32(0x20000000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Read32 of a hanging probe: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read32 returned after %s", d)
+	}
+
+	// the late response of the timed out command must not confuse the
+	// next one
+	p.Hang = false
+	p.Target.Write(0x20000000, 4, 0x12345678)
+	if err := dev.Write32(0x20000004, 0xcafebabe); err != nil {
+		t.Fatalf("Write32 after a timeout: %v", err)
+	}
+	v, err := dev.Read32(0x20000000)
+	if err != nil || v != 0x12345678 {
+		t.Errorf("Read32 after a timeout = %08x, %v", v, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	bus := sim.NewBus(p)
+	var events []stlink.ReconnectEvent
+	dev, err := stlink.NewWithBackend(bus).OpenDevice("", stlink.OpenOptions{
+		AutoReconnect: true,
+		OnReconnect: func(ev stlink.ReconnectEvent) {
+			events = append(events, ev)
+		},
+	})
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+	if err := dev.SetClockSpeed(480); err != nil {
+		t.Fatal(err)
+	}
+	divider := p.ClockDivider
+	if err := dev.Halt(); err != nil {
+		t.Fatal(err)
+	}
+	p.Target.Write(0x20000000, 4, 0x12345678)
+
+	// target reset, the command is retried after reconnecting
+	p.LoseTarget()
+	p.ClockDivider = 0
+	v, err := dev.Read32(0x20000000)
+	if err != nil || v != 0x12345678 {
+		t.Fatalf("Read32 after a target reset = %08x, %v", v, err)
+	}
+	if len(events) != 1 || !errors.Is(events[0].Cause, stlink.ErrSWDDPError) || events[0].Err != nil {
+		t.Fatalf("unexpected reconnect events: %+v", events)
+	}
+	if !p.Target.Halted || p.ClockDivider != divider {
+		t.Errorf("state not restored: halted %v, divider %d", p.Target.Halted, p.ClockDivider)
+	}
+
+	// probe unplugged, reconnecting fails until it is back
+	bus.Unplug(p)
+	if _, err := dev.Read32(0x20000000); !errors.Is(err, stlink.ErrDisconnected) {
+		t.Fatalf("Read32 of an unplugged probe: %v", err)
+	}
+	if len(events) != 2 || events[1].Err == nil {
+		t.Fatalf("unexpected reconnect events: %+v", events)
+	}
+	bus.Plug(p)
+	p.ClockDivider = 0
+	v, err = dev.Read32(0x20000000)
+	if err != nil || v != 0x12345678 {
+		t.Fatalf("Read32 after replugging = %08x, %v", v, err)
+	}
+	if len(events) != 3 || events[2].Err != nil || p.Mode != stlink.StlinkModeDebug {
+		t.Fatalf("unexpected reconnect events: %+v, mode %s", events, p.Mode)
+	}
+	if !p.Target.Halted || p.ClockDivider != divider {
+		t.Errorf("state not restored: halted %v, divider %d", p.Target.Halted, p.ClockDivider)
+	}
+
+	// a closed device stays closed
+	dev.Close()
+	if err := dev.Reconnect(); err == nil {
+		t.Error("Reconnect() of a closed device succeeded")
+	}
+	tr, err := bus.Open(stlink.ProbeInfo{PID: p.PID, SerialNumber: p.SerialNumber})
+	if err != nil {
+		t.Fatalf("probe still open after Reconnect() of a closed device: %v", err)
+	}
+	tr.Close()
+}
+
+// failDFUExit is a transport on which leaving the DFU mode fails
+type failDFUExit struct {
+	stlink.Transport
+}
+
+func (f failDFUExit) SendCommand(ctx context.Context, cmd []byte) error {
+	if cmd[0] == 0xf3 {
+		return errors.New("DFU exit failed")
+	}
+	return f.Transport.SendCommand(ctx, cmd)
+}
+
+func TestOpenDeviceDFUExitFails(t *testing.T) {
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	tr, err := sim.NewBus(p).Open(stlink.ProbeInfo{PID: p.PID, SerialNumber: p.SerialNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stlink.NewDevice(failDFUExit{tr}, p.PID); err == nil {
+		t.Error("NewDevice() succeeded while the probe stayed in DFU mode")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	a := sim.NewProbe("aa", sim.NewTarget(sim.STM32F103xB))
+	b := sim.NewProbe("bb", sim.NewTarget(sim.STM32F103xB))
+	// a clone of a
+	c := sim.NewProbe("aa", sim.NewTarget(sim.STM32F103xB))
+	bus := sim.NewBus(a)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := stlink.NewWithBackend(bus).Watch(ctx, stlink.WatchOptions{Interval: 5 * time.Millisecond})
+
+	next := func() stlink.ProbeEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no probe event")
+		}
+		return stlink.ProbeEvent{}
+	}
+	if ev := next(); ev.Type != stlink.ProbeArrived || ev.Probe.SerialNumber != "aa" || ev.Name != "ST-link V2" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	bus.Plug(b)
+	if ev := next(); ev.Type != stlink.ProbeArrived || ev.Probe.SerialNumber != "bb" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	bus.Plug(c)
+	if ev := next(); ev.Type != stlink.ProbeArrived || ev.Probe.SerialNumber != "aa" || ev.Probe.Path != c.Path {
+		t.Errorf("unexpected event for a clone: %+v", ev)
+	}
+	bus.Unplug(a)
+	if ev := next(); ev.Type != stlink.ProbeRemoved || ev.Probe.SerialNumber != "aa" || ev.Probe.Path != a.Path {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,162 @@
+package stlink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeoutError is returned when the target does not reach an expected
+// state in time
+type TimeoutError struct {
+	// Op is the operation which timed out
+	Op string
+	// Duration is the time waited
+	Duration time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: timeout after %s", e.Op, e.Duration)
+}
+
+// Timeout reports true, it makes TimeoutError match the net.Error style
+// timeout checks
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Errors reported by the probe in the status of a debug command, use
+// errors.Is to check for them
+var (
+	ErrFault              = errors.New("stlink: debug fault")
+	ErrJTAGGetIDCode      = errors.New("stlink: JTAG get IDCODE error")
+	ErrJTAGWrite          = errors.New("stlink: JTAG write error")
+	ErrJTAGWriteVerify    = errors.New("stlink: JTAG write verify error")
+	ErrSWDAPWait          = errors.New("stlink: SWD AP wait")
+	ErrSWDAPFault         = errors.New("stlink: SWD AP fault")
+	ErrSWDAPError         = errors.New("stlink: SWD AP error")
+	ErrSWDAPParity        = errors.New("stlink: SWD AP parity error")
+	ErrSWDDPWait          = errors.New("stlink: SWD DP wait")
+	ErrSWDDPFault         = errors.New("stlink: SWD DP fault")
+	ErrSWDDPError         = errors.New("stlink: SWD DP error")
+	ErrSWDDPParity        = errors.New("stlink: SWD DP parity error")
+	ErrSWDAPWData         = errors.New("stlink: SWD AP write data error")
+	ErrSWDAPSticky        = errors.New("stlink: SWD AP sticky error")
+	ErrSWDAPStickyOverrun = errors.New("stlink: SWD AP sticky overrun error")
+	ErrBadAP              = errors.New("stlink: bad AP")
+)
+
+// debugStatusOK is the status of a successful debug command
+const debugStatusOK = 0x80
+
+var debugStatusErrors = map[byte]error{
+	0x81: ErrFault,
+	0x09: ErrJTAGGetIDCode,
+	0x0c: ErrJTAGWrite,
+	0x0d: ErrJTAGWriteVerify,
+	0x10: ErrSWDAPWait,
+	0x11: ErrSWDAPFault,
+	0x12: ErrSWDAPError,
+	0x13: ErrSWDAPParity,
+	0x14: ErrSWDDPWait,
+	0x15: ErrSWDDPFault,
+	0x16: ErrSWDDPError,
+	0x17: ErrSWDDPParity,
+	0x18: ErrSWDAPWData,
+	0x19: ErrSWDAPSticky,
+	0x1a: ErrSWDAPStickyOverrun,
+	0x1d: ErrBadAP,
+}
+
+// statusError returns the error for the status byte of a debug command
+func statusError(status byte) error {
+	if status == debugStatusOK {
+		return nil
+	}
+	if err, ok := debugStatusErrors[status]; ok {
+		return err
+	}
+	return fmt.Errorf("stlink: unknown status %#02x", status)
+}
+
+// MemoryError is returned when a memory transfer failed, Err is the
+// status reported by the probe
+type MemoryError struct {
+	// Addr is the faulting address when the probe reports it, the
+	// start of the transfer otherwise
+	Addr uint32
+	Err  error
+}
+
+func (e *MemoryError) Error() string {
+	return fmt.Sprintf("memory access at 0x%08x: %v", e.Addr, e.Err)
+}
+
+func (e *MemoryError) Unwrap() error {
+	return e.Err
+}
+
+// ErrDisconnected is returned when the connection to the probe is lost,
+// a Transport wraps it in the errors of transfers to a probe which is
+// gone
+var ErrDisconnected = errors.New("stlink: probe disconnected")
+
+// ErrDeviceNotFound is returned by OpenDevice when no probe matches
+var ErrDeviceNotFound = errors.New("device not found")
+
+// AmbiguousError is returned by OpenDevice when several probes match,
+// the selection has to be narrowed down with OpenOptions
+type AmbiguousError struct {
+	Probes []ProbeInfo
+}
+
+func (e *AmbiguousError) Error() string {
+	s := make([]string, len(e.Probes))
+	for i, p := range e.Probes {
+		s[i] = fmt.Sprintf("%s at %s", p.SerialNumber, p.Path)
+	}
+	return fmt.Sprintf("%d probes match: %s", len(e.Probes), strings.Join(s, ", "))
+}
+
+// ErrFlashUnsupported is returned by Device.FlashLoader for a chip it
+// can't program
+var ErrFlashUnsupported = errors.New("stlink: flash programming not supported")
+
+// VerifyError is returned when the flash differs from the programmed
+// data, Addr is the first differing byte
+type VerifyError struct {
+	Addr uint32
+	Got  byte
+	Want byte
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify failed at 0x%08x: read %02x, expected %02x", e.Addr, e.Got, e.Want)
+}
+
+// Errors reported by a flash controller, a FlashError wraps them
+var (
+	ErrFlashLocked         = errors.New("stlink: flash is locked")
+	ErrFlashWriteProtected = errors.New("stlink: flash is write protected")
+	ErrFlashProgram        = errors.New("stlink: flash programming error")
+)
+
+// FlashError is returned when the flash controller fails an erase or
+// program operation
+type FlashError struct {
+	// Op is the failed operation, like "erase" or "program"
+	Op   string
+	Addr uint32
+	// Status is the status register of the flash controller
+	Status uint32
+	Err    error
+}
+
+func (e *FlashError) Error() string {
+	return fmt.Sprintf("flash %s at 0x%08x: %v (status %08x)", e.Op, e.Addr, e.Err, e.Status)
+}
+
+func (e *FlashError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,297 @@
+package stlink
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The flash of the STM32F0, F1 and F3 is erased in pages and programmed
+// a half-word at a time by the flash program and erase controller
+// (FPEC).
+
+const (
+	stm32fpFlashBase uint32 = 0x08000000
+	// stm32fpBank2Base is the start of bank 2 of the XL-density F1
+	stm32fpBank2Base uint32 = 0x08080000
+
+	fpecSRBusy     uint32 = 1 << 0
+	fpecSRPgErr    uint32 = 1 << 2
+	fpecSRWrPrtErr uint32 = 1 << 4
+	fpecSREOP      uint32 = 1 << 5
+
+	fpecCRPG   uint32 = 1 << 0
+	fpecCRPER  uint32 = 1 << 1
+	fpecCRMER  uint32 = 1 << 2
+	fpecCRStrt uint32 = 1 << 6
+	fpecCRLock uint32 = 1 << 7
+
+	// worst case durations from the datasheets, with a margin
+	fpecEraseTimeout     = 500 * time.Millisecond
+	fpecMassEraseTimeout = 5 * time.Second
+	fpecProgramTimeout   = 100 * time.Millisecond
+)
+
+// fpecBank is the register set of a flash bank
+type fpecBank struct {
+	keyr, sr, cr, ar uint32
+}
+
+var fpecBank1 = fpecBank{
+	keyr: 0x40022004,
+	sr:   0x4002200c,
+	cr:   0x40022010,
+	ar:   0x40022014,
+}
+
+var fpecBank2 = fpecBank{
+	keyr: 0x40022044,
+	sr:   0x4002204c,
+	cr:   0x40022050,
+	ar:   0x40022054,
+}
+
+// fpec drives a single bank of an FPEC
+type fpec struct {
+	d    *Device
+	bank fpecBank
+}
+
+func (f *fpec) unlock() error {
+	return f.d.unlockFlash(f.bank.keyr, f.bank.cr, fpecCRLock)
+}
+
+func (f *fpec) lock() error {
+	return f.d.Write32(f.bank.cr, fpecCRLock)
+}
+
+func (f *fpec) erasePage(addr uint32) error {
+	return f.erase("erase", addr, fpecCRPER, fpecEraseTimeout)
+}
+
+// massErase erases the bank, base is its first address
+func (f *fpec) massErase(base uint32) error {
+	return f.erase("mass erase", base, fpecCRMER, fpecMassEraseTimeout)
+}
+
+func (f *fpec) erase(op string, addr uint32, mode uint32, timeout time.Duration) error {
+	if err := f.start(op); err != nil {
+		return err
+	}
+	if err := f.d.Write32(f.bank.cr, mode); err != nil {
+		return err
+	}
+	if mode == fpecCRPER {
+		if err := f.d.Write32(f.bank.ar, addr); err != nil {
+			return err
+		}
+	}
+	if err := f.d.Write32(f.bank.cr, mode|fpecCRStrt); err != nil {
+		return err
+	}
+	return f.finish(op, addr, timeout)
+}
+
+// program writes data at addr in half-words, the FPEC stalls the bus
+// while it programs so a transfer may hold many of them
+func (f *fpec) program(addr uint32, data []byte) error {
+	if err := f.start("program"); err != nil {
+		return err
+	}
+	if err := f.d.Write32(f.bank.cr, fpecCRPG); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxRW32 {
+			n = maxRW32
+		}
+		if err := f.d.writeMem16(addr, data[:n]); err != nil {
+			return err
+		}
+		sr, err := f.wait("program", fpecProgramTimeout)
+		if err != nil {
+			return err
+		}
+		if err := fpecStatusError("program", addr, sr); err != nil {
+			f.d.Write32(f.bank.cr, 0)
+			return err
+		}
+		if err := f.clearEOP(); err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return f.d.Write32(f.bank.cr, 0)
+}
+
+// start waits for the FPEC to be idle and clears its status
+func (f *fpec) start(op string) error {
+	if _, err := f.wait(op, fpecEraseTimeout); err != nil {
+		return err
+	}
+	return f.d.Write32(f.bank.sr, fpecSREOP|fpecSRPgErr|fpecSRWrPrtErr)
+}
+
+// finish waits for an operation to end and checks its status
+func (f *fpec) finish(op string, addr uint32, timeout time.Duration) error {
+	sr, err := f.wait(op, timeout)
+	if err != nil {
+		return err
+	}
+	err = fpecStatusError(op, addr, sr)
+	if err == nil {
+		err = f.clearEOP()
+	}
+	if cerr := f.d.Write32(f.bank.cr, 0); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// clearEOP clears the end of operation flag, it is cleared by writing 1
+func (f *fpec) clearEOP() error {
+	return f.d.Write32(f.bank.sr, fpecSREOP)
+}
+
+func (f *fpec) wait(op string, timeout time.Duration) (uint32, error) {
+	return f.d.waitFlash(f.bank.sr, fpecSRBusy, op, timeout)
+}
+
+func fpecStatusError(op string, addr, sr uint32) error {
+	var err error
+	switch {
+	case sr&fpecSRWrPrtErr != 0:
+		err = ErrFlashWriteProtected
+	case sr&fpecSRPgErr != 0:
+		err = ErrFlashProgram
+	case sr&fpecSREOP == 0:
+		// the FPEC never did the operation
+		err = ErrFlashProgram
+	default:
+		return nil
+	}
+	return &FlashError{Op: op, Addr: addr, Status: sr, Err: err}
+}
+
+// stm32fp is the FlashLoader of the STM32F0, F1 and F3. The XL-density
+// F1 has a second bank with its own FPEC registers, the operations are
+// split over the banks.
+type stm32fp struct {
+	d *Device
+	g FlashGeometry
+	// banks in address order, with the first address of each
+	banks []*fpec
+	bases []uint32
+}
+
+// newSTM32FP creates the flash loader for a chip with pages of pageSize
+// bytes, the flash size is read from the chip. With dualBank set the
+// flash above 512KB is bank 2.
+func (d *Device) newSTM32FP(pageSize uint32, dualBank bool) (FlashLoader, error) {
+	// The FPEC only takes half-word writes, older firmware and the V1
+	// have no 16-bit memory transfers
+	if err := d.require(CapabilityMem16); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFlashUnsupported, err)
+	}
+	kb, err := d.FlashSize()
+	if err != nil {
+		return nil, err
+	}
+	l := &stm32fp{
+		d: d,
+		g: FlashGeometry{
+			Sectors:     uniformSectors(stm32fpFlashBase, pageSize, int(kb)*1024/int(pageSize)),
+			WriteSize:   2,
+			ErasedValue: 0xff,
+		},
+		banks: []*fpec{{d: d, bank: fpecBank1}},
+		bases: []uint32{stm32fpFlashBase},
+	}
+	if dualBank && l.g.Contains(stm32fpBank2Base, 1) {
+		l.banks = append(l.banks, &fpec{d: d, bank: fpecBank2})
+		l.bases = append(l.bases, stm32fpBank2Base)
+	}
+	return l, nil
+}
+
+// bank returns the index of the bank holding addr
+func (l *stm32fp) bank(addr uint32) int {
+	i := 0
+	for i+1 < len(l.bases) && addr >= l.bases[i+1] {
+		i++
+	}
+	return i
+}
+
+func (l *stm32fp) device() *Device {
+	return l.d
+}
+
+func (l *stm32fp) Init(voltage float32) error {
+	return nil
+}
+
+func (l *stm32fp) Geometry() FlashGeometry {
+	return l.g
+}
+
+func (l *stm32fp) Unlock() error {
+	for _, b := range l.banks {
+		if err := b.unlock(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *stm32fp) Lock() error {
+	var err error
+	for _, b := range l.banks {
+		if lerr := b.lock(); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+func (l *stm32fp) EraseSector(addr uint32) error {
+	s, ok := l.g.sector(addr)
+	if !ok {
+		return errors.New("address outside the flash")
+	}
+	return l.banks[l.bank(s.Addr)].erasePage(s.Addr)
+}
+
+func (l *stm32fp) MassErase() error {
+	for i, b := range l.banks {
+		if err := b.massErase(l.bases[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *stm32fp) Program(addr uint32, data []byte) error {
+	if err := l.g.checkProgram(addr, data); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		i := l.bank(addr)
+		n := len(data)
+		if i+1 < len(l.bases) && uint64(addr)+uint64(n) > uint64(l.bases[i+1]) {
+			n = int(l.bases[i+1] - addr)
+		}
+		if err := l.banks[i].program(addr, data[:n]); err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (l *stm32fp) Verify(addr uint32, data []byte) error {
+	return l.d.verifyFlash(addr, data)
+}
@@ -0,0 +1,214 @@
+package stlink_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestFlashSTM32FP(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	f := sim.NewFPEC(128*1024, 1024)
+	f.BusyPolls = 2
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	g := l.Geometry()
+	if g.Base() != 0x08000000 || g.Size() != 128*1024 || len(g.Sectors) != 128 || g.WriteSize != 2 {
+		t.Fatalf("geometry %08x+%x, %d sectors, write size %d", g.Base(), g.Size(), len(g.Sectors), g.WriteSize)
+	}
+
+	img := make([]byte, 3001)
+	for i := range img {
+		img[i] = byte(i * 7)
+	}
+	if err := stlink.WriteFlash(l, 0x08000400, img); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x400:0x400+len(img)], img) || f.Mem[0x400+len(img)] != 0xff {
+		t.Error("flash contents differ from the image")
+	}
+	if f.Erases != 3 || !f.Locked() {
+		t.Errorf("%d erases, locked %v", f.Erases, f.Locked())
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	defer l.Lock()
+	var ferr *stlink.FlashError
+	err = l.Program(0x08000400, []byte{0x12, 0x34})
+	if !errors.Is(err, stlink.ErrFlashProgram) || !errors.As(err, &ferr) || ferr.Op != "program" {
+		t.Errorf("Program over programmed flash: %v", err)
+	}
+	f.Protected[5] = true
+	err = l.EraseSector(0x08001432)
+	if !errors.Is(err, stlink.ErrFlashWriteProtected) || !errors.As(err, &ferr) || ferr.Addr != 0x08001400 {
+		t.Errorf("EraseSector of protected page: %v", err)
+	}
+	delete(f.Protected, 5)
+	if err := l.MassErase(); err != nil {
+		t.Fatalf("MassErase: %v", err)
+	}
+	if !bytes.Equal(f.Mem, bytes.Repeat([]byte{0xff}, len(f.Mem))) {
+		t.Error("flash not erased")
+	}
+	if sr, err := dev.Read32(0x4002200c); err != nil || sr&0x20 != 0 {
+		t.Errorf("EOP not cleared after MassErase: SR %08x, %v", sr, err)
+	}
+}
+
+func TestFlashSTM32FPNoEOP(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	f := sim.NewFPEC(128*1024, 1024)
+	f.Map(p.Target)
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	defer l.Lock()
+
+	// operations which end without EOP did nothing
+	f.NoEOP = true
+	if err := l.EraseSector(0x08000000); !errors.Is(err, stlink.ErrFlashProgram) {
+		t.Errorf("EraseSector without EOP: %v", err)
+	}
+	if err := l.Program(0x08000000, []byte{0x12, 0x34}); !errors.Is(err, stlink.ErrFlashProgram) {
+		t.Errorf("Program without EOP: %v", err)
+	}
+	f.NoEOP = false
+	if err := l.Program(0x08000002, []byte{0x12, 0x34}); err != nil {
+		t.Errorf("Program: %v", err)
+	}
+}
+
+func TestFlashSTM32FPRunningCore(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	f := sim.NewFPEC(128*1024, 1024)
+	f.Map(p.Target)
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+
+	// halted once for the whole write, and running again afterwards
+	if err := dev.Run(); err != nil {
+		t.Fatal(err)
+	}
+	p.Target.Halts = 0
+	if err := stlink.WriteFlash(l, 0x08000000, bytes.Repeat([]byte{0x5a}, 2048)); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if p.Target.Halts != 1 || p.Target.Halted {
+		t.Errorf("core halted %d times, halted %v", p.Target.Halts, p.Target.Halted)
+	}
+
+	// a halted core stays halted
+	if err := dev.Halt(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stlink.WriteFlash(l, 0x08000000, []byte{1, 2}); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !p.Target.Halted {
+		t.Error("core runs after WriteFlash")
+	}
+}
+
+func TestFlashSTM32FPUnlockFailure(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F072xB)
+	defer dev.Close()
+	f := sim.NewFPEC(128*1024, 2048)
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	if g := l.Geometry(); len(g.Sectors) != 64 || g.Sectors[1].Addr != 0x08000800 {
+		t.Errorf("geometry %+v", g.Sectors[:2])
+	}
+	// a wrong key locks the controller until reset
+	dev.Write32(0x40022004, 0x12345678)
+	if err := l.Unlock(); !errors.Is(err, stlink.ErrFlashLocked) {
+		t.Errorf("Unlock = %v", err)
+	}
+}
+
+func TestFlashSTM32FPXL(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xG)
+	defer dev.Close()
+	f := sim.NewFPEC(1024*1024, 2048)
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	if g := l.Geometry(); len(g.Sectors) != 512 || g.Size() != 1024*1024 {
+		t.Fatalf("geometry %d pages, %d bytes", len(g.Sectors), g.Size())
+	}
+
+	img := make([]byte, 1024*1024)
+	for i := range img {
+		img[i] = byte(i ^ i>>11)
+	}
+	if err := stlink.WriteFlash(l, 0x08000000, img); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(f.Mem, img) || f.Erases != 512 || !f.Locked() {
+		t.Fatalf("flash differs from the image, %d erases, locked %v", f.Erases, f.Locked())
+	}
+
+	// across the bank boundary, both banks erase their own pages
+	patch := bytes.Repeat([]byte{0x3c}, 8192)
+	if err := stlink.WriteFlash(l, 0x0807f000, patch); err != nil {
+		t.Fatalf("WriteFlash across banks: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x7f000:0x81000], patch) || !bytes.Equal(f.Mem[0x81000:], img[0x81000:]) {
+		t.Error("flash differs around the bank boundary")
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := l.MassErase(); err != nil {
+		t.Fatalf("MassErase: %v", err)
+	}
+	l.Lock()
+	if !bytes.Equal(f.Mem, bytes.Repeat([]byte{0xff}, len(f.Mem))) {
+		t.Error("flash not erased")
+	}
+}
+
+func TestFlashSTM32FPOldFirmware(t *testing.T) {
+	// J25 and the V1 have no 16-bit memory transfers
+	probes := []*sim.Probe{
+		sim.NewProbe("j25", sim.NewTarget(sim.STM32F103xB)),
+		sim.NewProbeV1("v1", 13, sim.NewTarget(sim.STM32F103xB)),
+	}
+	probes[0].JTAGVersion = 25
+	for _, p := range probes {
+		dev, err := stlink.NewWithBackend(sim.NewBus(p)).OpenDevice("")
+		if err != nil {
+			t.Fatalf("OpenDevice: %v", err)
+		}
+		sim.NewFPEC(128*1024, 1024).Map(p.Target)
+		if _, err := dev.FlashLoader(); !errors.Is(err, stlink.ErrFlashUnsupported) {
+			t.Errorf("%s: FlashLoader = %v", p.SerialNumber, err)
+		}
+		dev.Close()
+	}
+}
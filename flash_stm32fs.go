@@ -0,0 +1,315 @@
+package stlink
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The flash of the STM32F2, F4 and F7 is erased in sectors of 16KB up
+// to 256KB. It is programmed 8 to 64 bits at a time, the maximum
+// parallelism depends on the supply voltage. x64 needs an external
+// supply of 8-9V on the Vpp pin.
+
+const (
+	stm32fsFlashBase uint32 = 0x08000000
+	// stm32fsBank2Base is the second bank of 2MB chips
+	stm32fsBank2Base uint32 = 0x08100000
+
+	stm32fsKEYR uint32 = 0x40023c04
+	stm32fsSR   uint32 = 0x40023c0c
+	stm32fsCR   uint32 = 0x40023c10
+
+	stm32fsSREOP    uint32 = 1 << 0
+	stm32fsSROpErr  uint32 = 1 << 1
+	stm32fsSRWrpErr uint32 = 1 << 4
+	stm32fsSRPgaErr uint32 = 1 << 5
+	stm32fsSRPgpErr uint32 = 1 << 6
+	stm32fsSRPgsErr uint32 = 1 << 7
+	stm32fsSRBusy   uint32 = 1 << 16
+	stm32fsSRErrors        = stm32fsSROpErr | stm32fsSRWrpErr | stm32fsSRPgaErr | stm32fsSRPgpErr | stm32fsSRPgsErr
+
+	stm32fsCRPG         uint32 = 1 << 0
+	stm32fsCRSER        uint32 = 1 << 1
+	stm32fsCRMER        uint32 = 1 << 2
+	stm32fsCRSNBShift          = 3
+	stm32fsCRPSizeShift        = 8
+	stm32fsCRMER1       uint32 = 1 << 15
+	stm32fsCRStrt       uint32 = 1 << 16
+	stm32fsCRLock       uint32 = 1 << 31
+
+	// stm32fsSNBBank2 is set in the sector number of a bank 2 sector
+	stm32fsSNBBank2 uint32 = 0x10
+
+	// worst case durations for a 256KB sector and a 2MB mass erase at
+	// x8, with a margin
+	stm32fsEraseTimeout     = 10 * time.Second
+	stm32fsMassEraseTimeout = 60 * time.Second
+	stm32fsProgramTimeout   = 100 * time.Millisecond
+)
+
+// stm32fsPSize is the program parallelism, the value of CR.PSIZE
+type stm32fsPSize uint32
+
+const (
+	stm32fsPSize8 stm32fsPSize = iota
+	stm32fsPSize16
+	stm32fsPSize32
+	stm32fsPSize64
+)
+
+// bytes returns the number of bytes programmed at a time
+func (p stm32fsPSize) bytes() uint32 {
+	return 1 << p
+}
+
+// stm32fsParallelism returns the largest parallelism which is allowed
+// at the supply voltage, or with Vpp applied. x16 needs 16-bit transfers,
+// without mem16 the firmware lacks them and x8 is used instead.
+func stm32fsParallelism(voltage float32, vpp, mem16 bool) (stm32fsPSize, error) {
+	switch {
+	case voltage < 1.7:
+	case vpp:
+		return stm32fsPSize64, nil
+	case voltage >= 2.7:
+		return stm32fsPSize32, nil
+	case voltage >= 2.1 && mem16:
+		return stm32fsPSize16, nil
+	default:
+		return stm32fsPSize8, nil
+	}
+	return 0, fmt.Errorf("target voltage %.2fV too low to program flash", voltage)
+}
+
+// stm32fsLayout returns the sectors of kb KB of flash per bank: four of
+// unit bytes, one of 4*unit and the rest of 8*unit. A second bank
+// repeats the layout of the first.
+func stm32fsLayout(kb, unit uint32, banks int) ([]FlashSector, []uint32) {
+	var sectors []FlashSector
+	var snb []uint32
+	for b := 0; b < banks; b++ {
+		addr := stm32fsFlashBase
+		if b == 1 {
+			addr = stm32fsBank2Base
+		}
+		end := addr + kb*1024/uint32(banks)
+		for i := uint32(0); addr < end; i++ {
+			size := 8 * unit
+			switch {
+			case i < 4:
+				size = unit
+			case i == 4:
+				size = 4 * unit
+			}
+			sectors = append(sectors, FlashSector{Addr: addr, Size: size})
+			if b == 1 {
+				snb = append(snb, stm32fsSNBBank2|i)
+			} else {
+				snb = append(snb, i)
+			}
+			addr += size
+		}
+	}
+	return sectors, snb
+}
+
+// stm32fs is the FlashLoader of the STM32F2, F4 and F7
+type stm32fs struct {
+	d     *Device
+	g     FlashGeometry
+	snb   []uint32
+	banks int
+	psize stm32fsPSize
+	// voltage is the supply voltage of Init, vpp is set by SetVpp
+	voltage float32
+	vpp     bool
+}
+
+// newSTM32FS creates the flash loader for a chip whose first sectors are
+// unit bytes. 2MB chips with dualBank set have two banks.
+func (d *Device) newSTM32FS(unit uint32, dualBank bool) (FlashLoader, error) {
+	kb, err := d.FlashSize()
+	if err != nil {
+		return nil, err
+	}
+	banks := 1
+	if dualBank && kb == 2048 {
+		banks = 2
+	}
+	sectors, snb := stm32fsLayout(uint32(kb), unit, banks)
+	return &stm32fs{
+		d: d,
+		g: FlashGeometry{
+			Sectors:     sectors,
+			WriteSize:   stm32fsPSize8.bytes(),
+			ErasedValue: 0xff,
+		},
+		snb:   snb,
+		banks: banks,
+	}, nil
+}
+
+func (l *stm32fs) device() *Device {
+	return l.d
+}
+
+// Init picks the program parallelism for the supply voltage
+func (l *stm32fs) Init(voltage float32) error {
+	l.voltage = voltage
+	return l.setParallelism()
+}
+
+// SetVpp selects x64 programming when Vpp is applied, or the parallelism
+// of the supply voltage when it is not
+func (l *stm32fs) SetVpp(applied bool) error {
+	l.vpp = applied
+	return l.setParallelism()
+}
+
+func (l *stm32fs) setParallelism() error {
+	p, err := stm32fsParallelism(l.voltage, l.vpp, l.d.caps.Has(CapabilityMem16))
+	if err != nil {
+		return err
+	}
+	l.psize = p
+	l.g.WriteSize = p.bytes()
+	return nil
+}
+
+func (l *stm32fs) Geometry() FlashGeometry {
+	return l.g
+}
+
+func (l *stm32fs) Unlock() error {
+	return l.d.unlockFlash(stm32fsKEYR, stm32fsCR, stm32fsCRLock)
+}
+
+func (l *stm32fs) Lock() error {
+	return l.d.Write32(stm32fsCR, stm32fsCRLock)
+}
+
+func (l *stm32fs) EraseSector(addr uint32) error {
+	for i, s := range l.g.Sectors {
+		if addr >= s.Addr && addr-s.Addr < s.Size {
+			return l.erase("erase", s.Addr, stm32fsCRSER|l.snb[i]<<stm32fsCRSNBShift, stm32fsEraseTimeout)
+		}
+	}
+	return errors.New("address outside the flash")
+}
+
+func (l *stm32fs) MassErase() error {
+	mode := stm32fsCRMER
+	if l.banks == 2 {
+		mode |= stm32fsCRMER1
+	}
+	return l.erase("mass erase", l.g.Base(), mode, stm32fsMassEraseTimeout)
+}
+
+func (l *stm32fs) erase(op string, addr, mode uint32, timeout time.Duration) error {
+	if err := l.start(op); err != nil {
+		return err
+	}
+	cr := mode | uint32(l.psize)<<stm32fsCRPSizeShift
+	if err := l.d.Write32(stm32fsCR, cr); err != nil {
+		return err
+	}
+	if err := l.d.Write32(stm32fsCR, cr|stm32fsCRStrt); err != nil {
+		return err
+	}
+	sr, err := l.d.waitFlash(stm32fsSR, stm32fsSRBusy, op, timeout)
+	if err != nil {
+		return err
+	}
+	err = stm32fsStatusError(op, addr, sr)
+	if cerr := l.d.Write32(stm32fsCR, 0); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Program writes data in accesses of the program parallelism, x64 is
+// written as pairs of words
+func (l *stm32fs) Program(addr uint32, data []byte) error {
+	if err := l.g.checkProgram(addr, data); err != nil {
+		return err
+	}
+	if err := l.start("program"); err != nil {
+		return err
+	}
+	if err := l.d.Write32(stm32fsCR, stm32fsCRPG|uint32(l.psize)<<stm32fsCRPSizeShift); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n, err := l.write(addr, data)
+		if err != nil {
+			return err
+		}
+		sr, err := l.d.waitFlash(stm32fsSR, stm32fsSRBusy, "program", stm32fsProgramTimeout)
+		if err != nil {
+			return err
+		}
+		if err := stm32fsStatusError("program", addr, sr); err != nil {
+			l.d.Write32(stm32fsCR, 0)
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return l.d.Write32(stm32fsCR, 0)
+}
+
+// maxWrite8 returns the maximum size of a single 8-bit write
+func (d *Device) maxWrite8() int {
+	if d.caps.Has(CapabilityBulkWrite8) {
+		return 512
+	}
+	return 64
+}
+
+// write does a single transfer of the start of data to addr, it returns
+// the number of bytes written
+func (l *stm32fs) write(addr uint32, data []byte) (int, error) {
+	n := len(data)
+	limit := maxRW32
+	if l.psize == stm32fsPSize8 {
+		limit = l.d.maxWrite8()
+	}
+	if n > limit-int(addr)%limit {
+		n = limit - int(addr)%limit
+	}
+	var err error
+	switch l.psize {
+	case stm32fsPSize8:
+		err = l.d.writeMem8(addr, data[:n])
+	case stm32fsPSize16:
+		err = l.d.writeMem16(addr, data[:n])
+	default:
+		err = l.d.writeMem32(addr, data[:n])
+	}
+	return n, err
+}
+
+// start waits for the controller to be idle and clears its status
+func (l *stm32fs) start(op string) error {
+	if _, err := l.d.waitFlash(stm32fsSR, stm32fsSRBusy, op, stm32fsEraseTimeout); err != nil {
+		return err
+	}
+	return l.d.Write32(stm32fsSR, stm32fsSREOP|stm32fsSRErrors)
+}
+
+func (l *stm32fs) Verify(addr uint32, data []byte) error {
+	return l.d.verifyFlash(addr, data)
+}
+
+func stm32fsStatusError(op string, addr, sr uint32) error {
+	var err error
+	switch {
+	case sr&stm32fsSRWrpErr != 0:
+		err = ErrFlashWriteProtected
+	case sr&stm32fsSRErrors != 0:
+		err = ErrFlashProgram
+	default:
+		return nil
+	}
+	return &FlashError{Op: op, Addr: addr, Status: sr, Err: err}
+}
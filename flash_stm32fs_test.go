@@ -0,0 +1,141 @@
+package stlink_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+// newFlashF407 returns the 1MB flash of a STM32F407xG
+func newFlashF407() *sim.FlashF4 {
+	const k = 1024
+	return sim.NewFlashF4(16*k, 16*k, 16*k, 16*k, 64*k, 128*k, 128*k, 128*k, 128*k, 128*k, 128*k, 128*k)
+}
+
+func TestFlashSTM32FS(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F407xG)
+	defer dev.Close()
+	f := newFlashF407()
+	f.BusyPolls = 2
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	g := l.Geometry()
+	if len(g.Sectors) != 12 || g.Size() != 1024*1024 || g.Sectors[5].Addr != 0x08020000 || g.WriteSize != 4 {
+		t.Fatalf("geometry %d sectors, %d bytes, write size %d", len(g.Sectors), g.Size(), g.WriteSize)
+	}
+
+	img := make([]byte, 100*1024)
+	for i := range img {
+		img[i] = byte(i / 3)
+	}
+	touched := g.SectorsIn(0x08008000, uint32(len(img)))
+	if len(touched) != 4 || touched[0].Addr != 0x08008000 || touched[3].Addr != 0x08020000 {
+		t.Errorf("SectorsIn = %+v", touched)
+	}
+	if err := stlink.WriteFlash(l, 0x08008000, img); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x8000:0x8000+len(img)], img) {
+		t.Error("flash contents differ from the image")
+	}
+	if len(f.Erased) != 4 || f.Erased[0] != 2 || f.Erased[3] != 5 {
+		t.Errorf("erased sectors %v", f.Erased)
+	}
+	if len(f.WriteSizes) != 1 || f.WriteSizes[4] != len(img)/4 || !f.Locked() {
+		t.Errorf("writes %v, locked %v", f.WriteSizes, f.Locked())
+	}
+
+	f.Protected[7] = true
+	err = stlink.WriteFlash(l, 0x08060000, img[:16])
+	var ferr *stlink.FlashError
+	if !errors.Is(err, stlink.ErrFlashWriteProtected) || !errors.As(err, &ferr) || ferr.Addr != 0x08060000 {
+		t.Errorf("WriteFlash to protected sector: %v", err)
+	}
+}
+
+func TestFlashSTM32FSParallelism(t *testing.T) {
+	tests := []struct {
+		voltage float32
+		vpp     bool
+		size    int
+	}{
+		{3.3, false, 4},
+		{2.5, false, 2},
+		{1.9, false, 1},
+		{3.3, true, 8},
+		{1.9, true, 8},
+	}
+	for _, tc := range tests {
+		dev, p := openSim(t, sim.STM32F407xG)
+		p.Voltage = tc.voltage
+		f := newFlashF407()
+		f.Map(p.Target)
+
+		l, err := dev.FlashLoader()
+		if err == nil && tc.vpp {
+			err = l.(stlink.VppSetter).SetVpp(true)
+		}
+		if err != nil {
+			t.Fatalf("%.1fV: %v", tc.voltage, err)
+		}
+		if ws := l.Geometry().WriteSize; ws != uint32(tc.size) {
+			t.Errorf("%.1fV: write size %d, want %d", tc.voltage, ws, tc.size)
+		}
+		img := bytes.Repeat([]byte{0x5a, 0xa5}, 100)
+		if err := stlink.WriteFlash(l, 0x08004000, img); err != nil {
+			t.Errorf("%.1fV: WriteFlash: %v", tc.voltage, err)
+		}
+		// double words are written as pairs of words
+		access := tc.size
+		if access == 8 {
+			access = 4
+		}
+		if len(f.WriteSizes) != 1 || f.WriteSizes[access] != len(img)/access {
+			t.Errorf("%.1fV: writes %v, want %d-byte accesses", tc.voltage, f.WriteSizes, access)
+		}
+		dev.Close()
+	}
+
+	dev, p := openSim(t, sim.STM32F407xG)
+	defer dev.Close()
+	p.Voltage = 1.5
+	if _, err := dev.FlashLoader(); err == nil {
+		t.Error("FlashLoader succeeded at 1.5V")
+	}
+}
+
+func TestFlashSTM32FSOldFirmware(t *testing.T) {
+	// J25 has no 16-bit transfers, x8 is used where x16 would be
+	p := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F407xG))
+	p.JTAGVersion = 25
+	p.Voltage = 2.5
+	dev, err := stlink.NewWithBackend(sim.NewBus(p)).OpenDevice("")
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+	defer dev.Close()
+	f := newFlashF407()
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	if ws := l.Geometry().WriteSize; ws != 1 {
+		t.Errorf("write size %d, want 1", ws)
+	}
+	img := bytes.Repeat([]byte{0x5a, 0xa5}, 100)
+	if err := stlink.WriteFlash(l, 0x08004000, img); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x4000:0x4000+len(img)], img) {
+		t.Error("flash contents differ from the image")
+	}
+}
@@ -0,0 +1,300 @@
+package stlink
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The flash of the STM32L0 and L1 is erased in small pages to all
+// zeros, it is programmed a word or a half-page at a time. The chips
+// also have data EEPROM, which is written in bytes to words.
+
+const (
+	stm32lFlashBase  uint32 = 0x08000000
+	stm32lEEPROMBase uint32 = 0x08080000
+
+	// register offsets
+	stm32lPECR    uint32 = 0x04
+	stm32lPEKEYR  uint32 = 0x0c
+	stm32lPRGKEYR uint32 = 0x10
+	stm32lSR      uint32 = 0x18
+
+	stm32lPEKey1  uint32 = 0x89abcdef
+	stm32lPEKey2  uint32 = 0x02030405
+	stm32lPRGKey1 uint32 = 0x8c9daebf
+	stm32lPRGKey2 uint32 = 0x13141516
+
+	stm32lPECRPELock  uint32 = 1 << 0
+	stm32lPECRPrgLock uint32 = 1 << 1
+	stm32lPECRProg    uint32 = 1 << 3
+	stm32lPECRData    uint32 = 1 << 4
+	stm32lPECRErase   uint32 = 1 << 9
+	stm32lPECRFPrg    uint32 = 1 << 10
+
+	stm32lSRBusy   uint32 = 1 << 0
+	stm32lSREOP    uint32 = 1 << 1
+	stm32lSRWrpErr uint32 = 1 << 8
+	stm32lSRPgaErr uint32 = 1 << 9
+	stm32lSRSizErr uint32 = 1 << 10
+	stm32lSRErrors        = stm32lSRWrpErr | stm32lSRPgaErr | stm32lSRSizErr
+
+	// worst case durations, with a margin
+	stm32lEraseTimeout   = 100 * time.Millisecond
+	stm32lProgramTimeout = 100 * time.Millisecond
+
+	// stm32lEEPROMChunk is the number of EEPROM bytes written before
+	// waiting, a word takes up to 6.6ms when it has to be erased first
+	stm32lEEPROMChunk = 16
+)
+
+// stm32lFamily are the differences between the L0 and L1
+type stm32lFamily struct {
+	// regs is the base address of the flash registers
+	regs     uint32
+	pageSize uint32
+	// prefix and core find the part in the part list
+	prefix string
+	core   CortexMPartNumber
+}
+
+var (
+	stm32l0Family = stm32lFamily{
+		regs:     0x40022000,
+		pageSize: 128,
+		prefix:   "STM32L0",
+		core:     CortexMPartNumberM0Plus,
+	}
+	stm32l1Family = stm32lFamily{
+		regs:     0x40023c00,
+		pageSize: 256,
+		prefix:   "STM32L1",
+		core:     CortexMPartNumberM3,
+	}
+)
+
+// stm32l is the FlashLoader of the STM32L0 and L1, it is an EEPROMWriter
+// as well
+type stm32l struct {
+	d   *Device
+	g   FlashGeometry
+	reg stm32lFamily
+}
+
+// newSTM32L creates the flash loader for a chip of family f. The flash
+// size is read from the chip, the EEPROM size is that of the matching
+// parts in the part list.
+func (d *Device) newSTM32L(f stm32lFamily) (FlashLoader, error) {
+	kb, err := d.FlashSize()
+	if err != nil {
+		return nil, err
+	}
+	return &stm32l{
+		d: d,
+		g: FlashGeometry{
+			Sectors:     uniformSectors(stm32lFlashBase, f.pageSize, int(kb)*1024/int(f.pageSize)),
+			WriteSize:   4,
+			ErasedValue: 0x00,
+			EEPROM: FlashRegion{
+				Addr: stm32lEEPROMBase,
+				Size: uint32(eepromSize(f.core, f.prefix, uint(kb))),
+			},
+		},
+		reg: f,
+	}, nil
+}
+
+func (l *stm32l) device() *Device {
+	return l.d
+}
+
+func (l *stm32l) Init(voltage float32) error {
+	return nil
+}
+
+func (l *stm32l) Geometry() FlashGeometry {
+	return l.g
+}
+
+// Unlock unlocks the EEPROM and PECR, then the program flash
+func (l *stm32l) Unlock() error {
+	pecr, err := l.d.Read32(l.reg.regs + stm32lPECR)
+	if err != nil {
+		return err
+	}
+	if pecr&stm32lPECRPELock != 0 {
+		if err := l.keys(stm32lPEKEYR, stm32lPEKey1, stm32lPEKey2); err != nil {
+			return err
+		}
+	}
+	if pecr&stm32lPECRPrgLock != 0 {
+		if err := l.keys(stm32lPRGKEYR, stm32lPRGKey1, stm32lPRGKey2); err != nil {
+			return err
+		}
+	}
+	pecr, err = l.d.Read32(l.reg.regs + stm32lPECR)
+	if err != nil {
+		return err
+	}
+	if pecr&(stm32lPECRPELock|stm32lPECRPrgLock) != 0 {
+		// A wrong key sequence locks the flash until reset
+		return ErrFlashLocked
+	}
+	return nil
+}
+
+func (l *stm32l) keys(keyr, key1, key2 uint32) error {
+	if err := l.d.Write32(l.reg.regs+keyr, key1); err != nil {
+		return err
+	}
+	return l.d.Write32(l.reg.regs+keyr, key2)
+}
+
+// Lock locks PECR, which locks the program flash and EEPROM as well
+func (l *stm32l) Lock() error {
+	return l.d.Write32(l.reg.regs+stm32lPECR, stm32lPECRPELock)
+}
+
+// EraseSector erases a page by writing a zero word into it in erase mode
+func (l *stm32l) EraseSector(addr uint32) error {
+	s, ok := l.g.sector(addr)
+	if !ok {
+		return errors.New("address outside the flash")
+	}
+	return l.run("erase", s.Addr, stm32lPECRErase|stm32lPECRProg, stm32lEraseTimeout, func() error {
+		return l.d.Write32(s.Addr, 0)
+	})
+}
+
+// MassErase erases the flash page by page, the chip has no mass erase
+// other than a read protection level change
+func (l *stm32l) MassErase() error {
+	for _, s := range l.g.Sectors {
+		if err := l.EraseSector(s.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Program writes whole half-pages in one go, the rest a word at a time
+func (l *stm32l) Program(addr uint32, data []byte) error {
+	if err := l.g.checkProgram(addr, data); err != nil {
+		return err
+	}
+	half := l.reg.pageSize / 2
+	for len(data) > 0 {
+		n := 4
+		mode := uint32(0)
+		if addr%half == 0 && len(data) >= int(half) {
+			n = int(half)
+			mode = stm32lPECRProg | stm32lPECRFPrg
+		}
+		chunk := data[:n]
+		err := l.run("program", addr, mode, stm32lProgramTimeout, func() error {
+			return l.d.writeMem32(addr, chunk)
+		})
+		if err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (l *stm32l) Verify(addr uint32, data []byte) error {
+	return l.d.verifyFlash(addr, data)
+}
+
+// WriteEEPROM writes data to the EEPROM, a word which is not erased is
+// erased by the chip before it is written. The writes are done in
+// chunks, so each fits in the program timeout.
+func (l *stm32l) WriteEEPROM(addr uint32, data []byte) error {
+	if err := l.checkEEPROM(addr, uint32(len(data))); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := int(stm32lEEPROMChunk - addr%stm32lEEPROMChunk)
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk := data[:n]
+		err := l.run("eeprom write", addr, 0, stm32lProgramTimeout, func() error {
+			return l.d.WriteMem(addr, chunk)
+		})
+		if err != nil {
+			return err
+		}
+		addr += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (l *stm32l) EraseEEPROM(addr, n uint32) error {
+	if err := l.checkEEPROM(addr, n); err != nil {
+		return err
+	}
+	if addr%4 != 0 || n%4 != 0 {
+		return fmt.Errorf("eeprom erase at 0x%08x+%d is not word aligned", addr, n)
+	}
+	for a := addr; a < addr+n; a += 4 {
+		err := l.run("eeprom erase", a, stm32lPECRErase|stm32lPECRData, stm32lEraseTimeout, func() error {
+			return l.d.Write32(a, 0)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *stm32l) checkEEPROM(addr, n uint32) error {
+	e := l.g.EEPROM
+	if addr < e.Addr || uint64(addr)+uint64(n) > uint64(e.Addr)+uint64(e.Size) {
+		return fmt.Errorf("0x%08x+%d is outside the eeprom", addr, n)
+	}
+	return nil
+}
+
+// run does an operation with PECR set to mode: f starts it with a write
+// to the memory, then its end is awaited
+func (l *stm32l) run(op string, addr, mode uint32, timeout time.Duration, f func() error) error {
+	sr := l.reg.regs + stm32lSR
+	pecr := l.reg.regs + stm32lPECR
+	if _, err := l.d.waitFlash(sr, stm32lSRBusy, op, timeout); err != nil {
+		return err
+	}
+	if err := l.d.Write32(sr, stm32lSREOP|stm32lSRErrors); err != nil {
+		return err
+	}
+	if err := l.d.Write32(pecr, mode); err != nil {
+		return err
+	}
+	err := f()
+	if err == nil {
+		var status uint32
+		status, err = l.d.waitFlash(sr, stm32lSRBusy, op, timeout)
+		if err == nil {
+			err = stm32lStatusError(op, addr, status)
+		}
+	}
+	if cerr := l.d.Write32(pecr, 0); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func stm32lStatusError(op string, addr, sr uint32) error {
+	var err error
+	switch {
+	case sr&stm32lSRWrpErr != 0:
+		err = ErrFlashWriteProtected
+	case sr&stm32lSRErrors != 0:
+		err = ErrFlashProgram
+	default:
+		return nil
+	}
+	return &FlashError{Op: op, Addr: addr, Status: sr, Err: err}
+}
@@ -0,0 +1,146 @@
+package stlink_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestFlashSTM32L0(t *testing.T) {
+	dev, p := openSim(t, sim.STM32L053x8)
+	defer dev.Close()
+	f := sim.NewFlashL0(64*1024, 2048)
+	f.BusyPolls = 2
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	g := l.Geometry()
+	if len(g.Sectors) != 512 || g.Size() != 64*1024 || g.WriteSize != 4 || g.ErasedValue != 0 {
+		t.Fatalf("geometry %d pages, %d bytes, write size %d", len(g.Sectors), g.Size(), g.WriteSize)
+	}
+	if g.EEPROM != (stlink.FlashRegion{Addr: 0x08080000, Size: 2048}) {
+		t.Errorf("EEPROM %+v", g.EEPROM)
+	}
+
+	// a half-page and a word before, three half-pages and a partial word
+	// after it
+	img := make([]byte, 4+4*64+5)
+	for i := range img {
+		img[i] = byte(i*5 + 1)
+	}
+	if err := stlink.WriteFlash(l, 0x0800013c, img); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x13c:0x13c+len(img)], img) || f.Mem[0x13c+len(img)] != 0 {
+		t.Error("flash contents differ from the image")
+	}
+	if f.Erases != 3 || f.HalfPages != 4 || !f.Locked() {
+		t.Errorf("%d erases, %d half-pages, locked %v", f.Erases, f.HalfPages, f.Locked())
+	}
+
+	f.Protected[4] = true
+	err = stlink.WriteFlash(l, 0x08000200, img[:8])
+	var ferr *stlink.FlashError
+	if !errors.Is(err, stlink.ErrFlashWriteProtected) || !errors.As(err, &ferr) || ferr.Addr != 0x08000200 {
+		t.Errorf("WriteFlash to protected page: %v", err)
+	}
+	if !f.Locked() {
+		t.Error("flash left unlocked")
+	}
+}
+
+func TestFlashSTM32LEEPROM(t *testing.T) {
+	dev, p := openSim(t, sim.STM32L152xE)
+	defer dev.Close()
+	f := sim.NewFlashL1(512*1024, 16*1024)
+	f.BusyPolls = 1
+	f.Map(p.Target)
+
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	g := l.Geometry()
+	if len(g.Sectors) != 2048 || g.Sectors[1].Addr != 0x08000100 || g.EEPROM.Size != 16*1024 {
+		t.Fatalf("geometry %d pages, EEPROM %+v", len(g.Sectors), g.EEPROM)
+	}
+	e, ok := l.(stlink.EEPROMWriter)
+	if !ok {
+		t.Fatal("loader does not write EEPROM")
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	data := []byte("data eeprom")
+	if err := e.WriteEEPROM(0x08080102, data); err != nil {
+		t.Fatalf("WriteEEPROM: %v", err)
+	}
+	if !bytes.Equal(f.EEPROM[0x102:0x102+len(data)], data) {
+		t.Error("EEPROM contents differ")
+	}
+	if err := e.EraseEEPROM(0x08080100, 8); err != nil {
+		t.Fatalf("EraseEEPROM: %v", err)
+	}
+	want := append(make([]byte, 6), data[6:]...)
+	if !bytes.Equal(f.EEPROM[0x102:0x102+len(data)], want) {
+		t.Errorf("EEPROM after erase % x", f.EEPROM[0x102:0x102+len(data)])
+	}
+	if err := e.WriteEEPROM(0x08083ffe, data); err == nil {
+		t.Error("WriteEEPROM past the EEPROM succeeded")
+	}
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := e.WriteEEPROM(0x08080000, data); !errors.Is(err, stlink.ErrFlashWriteProtected) {
+		t.Errorf("WriteEEPROM while locked: %v", err)
+	}
+}
+
+func TestFlashSTM32LCat4(t *testing.T) {
+	dev, p := openSim(t, sim.STM32L152xD)
+	defer dev.Close()
+	f := sim.NewFlashL1(384*1024, 12*1024)
+	f.Map(p.Target)
+
+	if kb, err := dev.FlashSize(); err != nil || kb != 384 {
+		t.Fatalf("FlashSize() = %d, %v", kb, err)
+	}
+	l, err := dev.FlashLoader()
+	if err != nil {
+		t.Fatalf("FlashLoader: %v", err)
+	}
+	g := l.Geometry()
+	if len(g.Sectors) != 1536 || g.Size() != 384*1024 || g.EEPROM.Size != 12*1024 {
+		t.Fatalf("geometry %d pages, %d bytes, EEPROM %+v", len(g.Sectors), g.Size(), g.EEPROM)
+	}
+	img := bytes.Repeat([]byte{0xa5, 0x5a, 0x01, 0x10}, 128)
+	if err := stlink.WriteFlash(l, 0x0805fe00, img); err != nil {
+		t.Fatalf("WriteFlash at the end of the flash: %v", err)
+	}
+	if !bytes.Equal(f.Mem[0x5fe00:], img) {
+		t.Error("flash contents differ from the image")
+	}
+
+	// the whole EEPROM at once
+	data := make([]byte, 12*1024-3)
+	for i := range data {
+		data[i] = byte(i*3 + 1)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	defer l.Lock()
+	if err := l.(stlink.EEPROMWriter).WriteEEPROM(0x08080003, data); err != nil {
+		t.Fatalf("WriteEEPROM: %v", err)
+	}
+	if !bytes.Equal(f.EEPROM[3:], data) {
+		t.Error("EEPROM contents differ")
+	}
+}
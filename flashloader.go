@@ -1,52 +1,337 @@
 package stlink
 
 import (
-	"errors"
+	"fmt"
+	"time"
 )
 
+// FlashSector is an erase unit of the flash, chips with erase units of
+// equal size call it a page
+type FlashSector struct {
+	Addr uint32
+	Size uint32
+}
+
+// FlashRegion is a range of target memory
+type FlashRegion struct {
+	Addr uint32
+	Size uint32
+}
+
+// FlashGeometry describes the layout of the flash of a chip
+type FlashGeometry struct {
+	// Sectors are the erase units in address order, without gaps
+	Sectors []FlashSector
+	// WriteSize is the alignment and size multiple of Program
+	WriteSize uint32
+	// ErasedValue is the value of an erased byte
+	ErasedValue byte
+	// EEPROM is the data EEPROM, its Size is zero for a chip without.
+	// It is written with the EEPROMWriter of the loader.
+	EEPROM FlashRegion
+}
+
+// Base returns the address of the first byte of flash
+func (g FlashGeometry) Base() uint32 {
+	if len(g.Sectors) == 0 {
+		return 0
+	}
+	return g.Sectors[0].Addr
+}
+
+// Size returns the size of the flash in bytes
+func (g FlashGeometry) Size() uint32 {
+	var n uint32
+	for _, s := range g.Sectors {
+		n += s.Size
+	}
+	return n
+}
+
+// Contains reports whether [addr, addr+n) lies within the flash
+func (g FlashGeometry) Contains(addr, n uint32) bool {
+	return addr >= g.Base() && uint64(addr)+uint64(n) <= uint64(g.Base())+uint64(g.Size())
+}
+
+// SectorsIn returns the sectors holding any byte of [addr, addr+n)
+func (g FlashGeometry) SectorsIn(addr, n uint32) []FlashSector {
+	var sectors []FlashSector
+	end := uint64(addr) + uint64(n)
+	for _, s := range g.Sectors {
+		if uint64(s.Addr) < end && uint64(addr) < uint64(s.Addr)+uint64(s.Size) {
+			sectors = append(sectors, s)
+		}
+	}
+	return sectors
+}
+
+// sector returns the sector holding addr
+func (g FlashGeometry) sector(addr uint32) (FlashSector, bool) {
+	s := g.SectorsIn(addr, 1)
+	if len(s) == 0 {
+		return FlashSector{}, false
+	}
+	return s[0], true
+}
+
+// checkProgram checks that data at addr can be programmed in one go
+func (g FlashGeometry) checkProgram(addr uint32, data []byte) error {
+	if addr%g.WriteSize != 0 || uint32(len(data))%g.WriteSize != 0 {
+		return fmt.Errorf("program at 0x%08x+%d is not aligned to %d bytes", addr, len(data), g.WriteSize)
+	}
+	if !g.Contains(addr, uint32(len(data))) {
+		return fmt.Errorf("0x%08x+%d is outside the flash", addr, len(data))
+	}
+	return nil
+}
+
+// uniformSectors returns n sectors of size bytes starting at base
+func uniformSectors(base, size uint32, n int) []FlashSector {
+	sectors := make([]FlashSector, n)
+	for i := range sectors {
+		sectors[i] = FlashSector{Addr: base + uint32(i)*size, Size: size}
+	}
+	return sectors
+}
+
+// FlashLoader erases and programs the flash of a chip. Get the one for
+// the target with Device.FlashLoader, or use WriteFlash to program an
+// image in one go.
 type FlashLoader interface {
+	// Init prepares the loader for the given target supply voltage
 	Init(voltage float32) error
+	// Geometry describes the flash
+	Geometry() FlashGeometry
+	// Unlock enables erasing and programming the flash, Lock disables
+	// it again
+	Unlock() error
+	Lock() error
+	// EraseSector erases the sector, or page, holding addr
+	EraseSector(addr uint32) error
+	// MassErase erases all of the flash
+	MassErase() error
+	// Program writes data to erased flash at addr, both are aligned to
+	// Geometry().WriteSize
+	Program(addr uint32, data []byte) error
+	// Verify compares the flash at addr with data, a difference is
+	// returned as *VerifyError
+	Verify(addr uint32, data []byte) error
 }
 
-func (d *Device) getFlashloader() (FlashLoader, error) {
-	pn, err := d.DevID()
+// EEPROMWriter is implemented by the FlashLoader of a chip with data
+// EEPROM, see FlashGeometry.EEPROM. It needs the loader to be unlocked.
+type EEPROMWriter interface {
+	// WriteEEPROM writes data to the EEPROM at addr, any alignment
+	WriteEEPROM(addr uint32, data []byte) error
+	// EraseEEPROM erases n bytes of EEPROM at addr, both are word
+	// aligned
+	EraseEEPROM(addr, n uint32) error
+}
+
+// VppSetter is implemented by the FlashLoader of a chip which programs
+// more bits at a time with an external supply on its Vpp pin
+type VppSetter interface {
+	// SetVpp tells the loader whether Vpp is applied, it changes the
+	// WriteSize of the geometry
+	SetVpp(applied bool) error
+}
+
+// FlashLoader returns the flash loader for the target chip, initialized
+// for the measured target voltage. The core should be halted while the
+// flash is erased or programmed.
+func (d *Device) FlashLoader() (FlashLoader, error) {
+	l, err := d.getFlashloader()
 	if err != nil {
 		return nil, err
 	}
-	/*v, err := d.TargetVoltage()
+	v, err := d.TargetVoltage()
 	if err != nil {
 		return nil, err
-	}*/
+	}
+	if err := l.Init(v); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (d *Device) getFlashloader() (FlashLoader, error) {
+	pn, err := d.DevID()
+	if err != nil {
+		return nil, err
+	}
 
 	switch pn {
-	case ChipFamilySTM32F0, ChipFamilySTM32F09X, ChipFamilySTM32F0Small,
-		ChipFamilySTM32F04, ChipFamilySTM32F0Can, ChipFamilySTM32F1Medium,
-		ChipFamilySTM32F1Low, ChipFamilySTM32F1High, ChipFamilySTM32F1Connectivity,
-		ChipFamilySTM32F1VLMedium, ChipFamilySTM32F3, ChipFamilySTM32F1VLHigh,
+	case ChipFamilySTM32F0, ChipFamilySTM32F0Small, ChipFamilySTM32F04,
+		ChipFamilySTM32F1Medium, ChipFamilySTM32F1Low, ChipFamilySTM32F1VLMedium:
+		// STM32FP with 1KB pages
+		return d.newSTM32FP(0x400, false)
+	case ChipFamilySTM32F09X, ChipFamilySTM32F0Can, ChipFamilySTM32F1High,
+		ChipFamilySTM32F1Connectivity, ChipFamilySTM32F3, ChipFamilySTM32F1VLHigh,
 		ChipFamilySTM32F37x, ChipFamilySTM32F334, ChipFamilySTM32F3Small,
 		ChipFamilySTM32F303High:
-		// STM32FP
-		return nil, nil
-	case ChipFamilySTM32F2, ChipFamilySTM32F4, ChipFamilySTM32F4HD,
-		ChipFamilySTM32F446, ChipFamilySTM32F4LP, ChipFamilySTM32F411RE,
-		ChipFamilySTM32F4DE, ChipFamilySTM32F4DSI, ChipFamilySTM32F412,
-		ChipFamilySTM32F410, ChipFamilySTM32F7, ChipFamilySTM32F7Advanced,
-		ChipFamilySTM32F413, ChipFamilySTM32F7Foundation:
-		// STM32FS
-		/*l := stm32fs.STM32FS{}
-		l.Init(v)
-		return l, nil*/
+		// STM32FP with 2KB pages
+		return d.newSTM32FP(0x800, false)
+	case ChipFamilySTM32F2, ChipFamilySTM32F4, ChipFamilySTM32F446,
+		ChipFamilySTM32F4LP, ChipFamilySTM32F411RE, ChipFamilySTM32F4DE,
+		ChipFamilySTM32F412, ChipFamilySTM32F410, ChipFamilySTM32F413,
+		ChipFamilySTM32F7Foundation:
+		// STM32FS with 16KB sectors
+		return d.newSTM32FS(16*1024, false)
+	case ChipFamilySTM32F4HD, ChipFamilySTM32F4DSI:
+		// STM32FS with 16KB sectors, dual bank at 2MB
+		return d.newSTM32FS(16*1024, true)
+	case ChipFamilySTM32F7, ChipFamilySTM32F7Advanced:
+		// STM32FS with 32KB sectors
+		return d.newSTM32FS(32*1024, false)
 	case ChipFamilySTM32F1XL:
-		// STM32FPXL
-		return nil, nil
+		// STM32FPXL, two banks with 2KB pages
+		return d.newSTM32FP(0x800, true)
 	case ChipFamilySTM32L011, ChipFamilySTM32L0Cat2, ChipFamilySTM32L0,
 		ChipFamilySTM32L0Cat5:
 		//STM32L0
+		return d.newSTM32L(stm32l0Family)
 	case ChipFamilySTM32L1MediumLow, ChipFamilySTM32L1MediumHigh, ChipFamilySTM32L1Cat2,
-		ChipFamilySTM32L1High, ChipFamilySTM32L152RE, ChipFamilySTM32L4,
-		ChipFamilySTM32L434X, ChipFamilySTM32L4X6:
+		ChipFamilySTM32L1High, ChipFamilySTM32L152RE:
+		// STM32L1
+		return d.newSTM32L(stm32l1Family)
+	case ChipFamilySTM32L4, ChipFamilySTM32L434X, ChipFamilySTM32L4X6:
 		// None
-		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown core %03x", uint16(pn))
+	}
+	return nil, fmt.Errorf("%w: %03x", ErrFlashUnsupported, uint16(pn))
+}
+
+// Keys of the flash controllers of the F-series, written to their KEYR
+// in this order
+const (
+	flashKey1 uint32 = 0x45670123
+	flashKey2 uint32 = 0xcdef89ab
+)
+
+// unlockFlash unlocks a flash controller by writing the keys to keyr,
+// lock is the lock bit of control register cr
+func (d *Device) unlockFlash(keyr, cr, lock uint32) error {
+	v, err := d.Read32(cr)
+	if err != nil {
+		return err
+	}
+	if v&lock == 0 {
+		return nil
+	}
+	if err := d.Write32(keyr, flashKey1); err != nil {
+		return err
+	}
+	if err := d.Write32(keyr, flashKey2); err != nil {
+		return err
+	}
+	v, err = d.Read32(cr)
+	if err != nil {
+		return err
+	}
+	if v&lock != 0 {
+		// A wrong key sequence locks the controller until reset
+		return ErrFlashLocked
+	}
+	return nil
+}
+
+// waitFlash polls status register sr of a flash controller until its
+// busy bit clears, it returns the last status
+func (d *Device) waitFlash(sr, busy uint32, op string, timeout time.Duration) (uint32, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		v, err := d.Read32(sr)
+		if err != nil {
+			return 0, err
+		}
+		if v&busy == 0 {
+			return v, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, &TimeoutError{Op: "flash " + op, Duration: timeout}
+		}
+	}
+}
+
+// verifyFlash reads back the flash at addr and compares it with data
+func (d *Device) verifyFlash(addr uint32, data []byte) error {
+	buf := make([]byte, len(data))
+	if err := d.ReadMem(addr, buf); err != nil {
+		return err
+	}
+	for i := range data {
+		if buf[i] != data[i] {
+			return &VerifyError{Addr: addr + uint32(i), Got: buf[i], Want: data[i]}
+		}
+	}
+	return nil
+}
+
+// WriteFlash programs data at addr with l. Every sector data touches is
+// erased first, so the rest of those sectors is lost. The data is
+// verified after programming and the flash is locked again. A running
+// core is halted for the whole write and runs again afterwards.
+func WriteFlash(l FlashLoader, addr uint32, data []byte) (err error) {
+	g := l.Geometry()
+	if !g.Contains(addr, uint32(len(data))) {
+		return fmt.Errorf("0x%08x+%d is outside the flash", addr, len(data))
+	}
+	if fd, ok := l.(flashDevice); ok {
+		var resume func(*error)
+		resume, err = haltForFlash(fd.device())
+		if err != nil {
+			return err
+		}
+		defer resume(&err)
+	}
+	if err := l.Unlock(); err != nil {
+		return err
+	}
+	err = writeFlash(l, g, addr, data)
+	if lerr := l.Lock(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// flashDevice is implemented by the loaders of this package, it gives
+// the device of the target
+type flashDevice interface {
+	device() *Device
+}
+
+// haltForFlash halts the core of d, so it doesn't run from the flash
+// while it is erased. The state of the core is read first, it may have
+// changed since the last command.
+func haltForFlash(d *Device) (func(*error), error) {
+	if _, err := d.Status(); err != nil {
+		return nil, err
+	}
+	return d.haltTemporarily()
+}
+
+func writeFlash(l FlashLoader, g FlashGeometry, addr uint32, data []byte) error {
+	for _, s := range g.SectorsIn(addr, uint32(len(data))) {
+		if err := l.EraseSector(s.Addr); err != nil {
+			return err
+		}
+	}
+	// Pad to the program size with the erased value, which leaves the
+	// padding as erased
+	start := addr
+	img := data
+	if g.WriteSize > 1 {
+		start = addr &^ (g.WriteSize - 1)
+		end := (addr + uint32(len(data)) + g.WriteSize - 1) &^ (g.WriteSize - 1)
+		img = make([]byte, end-start)
+		for i := range img {
+			img[i] = g.ErasedValue
+		}
+		copy(img[addr-start:], data)
+	}
+	if err := l.Program(start, img); err != nil {
+		return err
 	}
-	return nil, errors.New("unknown core")
+	return l.Verify(addr, data)
 }
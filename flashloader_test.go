@@ -0,0 +1,111 @@
+package stlink_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+)
+
+// memFlash is a FlashLoader for flash kept in memory
+type memFlash struct {
+	g      stlink.FlashGeometry
+	mem    []byte
+	locked bool
+	erased []uint32
+}
+
+func newMemFlash() *memFlash {
+	return &memFlash{
+		g: stlink.FlashGeometry{
+			Sectors: []stlink.FlashSector{
+				{Addr: 0x08000000, Size: 0x400},
+				{Addr: 0x08000400, Size: 0x400},
+				{Addr: 0x08000800, Size: 0x800},
+			},
+			WriteSize:   4,
+			ErasedValue: 0xff,
+		},
+		mem:    bytes.Repeat([]byte{0xff}, 0x1000),
+		locked: true,
+	}
+}
+
+func (f *memFlash) Init(voltage float32) error     { return nil }
+func (f *memFlash) Geometry() stlink.FlashGeometry { return f.g }
+func (f *memFlash) Unlock() error                  { f.locked = false; return nil }
+func (f *memFlash) Lock() error                    { f.locked = true; return nil }
+func (f *memFlash) MassErase() error               { return f.erase(f.g.Sectors...) }
+func (f *memFlash) EraseSector(addr uint32) error  { return f.erase(f.g.SectorsIn(addr, 1)...) }
+
+func (f *memFlash) off(addr uint32) uint32 {
+	return addr - f.g.Base()
+}
+
+func (f *memFlash) erase(sectors ...stlink.FlashSector) error {
+	if f.locked {
+		return errors.New("locked")
+	}
+	for _, s := range sectors {
+		copy(f.mem[f.off(s.Addr):], bytes.Repeat([]byte{0xff}, int(s.Size)))
+		f.erased = append(f.erased, s.Addr)
+	}
+	return nil
+}
+
+func (f *memFlash) Program(addr uint32, data []byte) error {
+	if f.locked || addr%f.g.WriteSize != 0 || uint32(len(data))%f.g.WriteSize != 0 {
+		return errors.New("invalid program")
+	}
+	for i, b := range data {
+		// programming can only clear bits
+		f.mem[f.off(addr)+uint32(i)] &= b
+	}
+	return nil
+}
+
+func (f *memFlash) Verify(addr uint32, data []byte) error {
+	for i, b := range data {
+		if got := f.mem[f.off(addr)+uint32(i)]; got != b {
+			return &stlink.VerifyError{Addr: addr + uint32(i), Got: got, Want: b}
+		}
+	}
+	return nil
+}
+
+func TestWriteFlash(t *testing.T) {
+	f := newMemFlash()
+	g := f.Geometry()
+	if g.Base() != 0x08000000 || g.Size() != 0x1000 {
+		t.Fatalf("geometry %08x+%x", g.Base(), g.Size())
+	}
+	if s := g.SectorsIn(0x080003ff, 2); len(s) != 2 || s[1].Addr != 0x08000400 {
+		t.Errorf("SectorsIn = %+v", s)
+	}
+
+	// unaligned and spanning two sectors, the third keeps its contents
+	f.Unlock()
+	f.Program(0x08000800, []byte{1, 2, 3, 4})
+	f.Lock()
+	data := []byte("hello, flash")
+	if err := stlink.WriteFlash(f, 0x080003fe, data); err != nil {
+		t.Fatalf("WriteFlash: %v", err)
+	}
+	if !f.locked {
+		t.Error("flash left unlocked")
+	}
+	if len(f.erased) != 2 || f.erased[0] != 0x08000000 || f.erased[1] != 0x08000400 {
+		t.Errorf("erased %x", f.erased)
+	}
+	if !bytes.Equal(f.mem[0x3fe:0x3fe+len(data)], data) || f.mem[0x3fd] != 0xff {
+		t.Errorf("flash holds % x", f.mem[0x3fc:0x410])
+	}
+	if !bytes.Equal(f.mem[0x800:0x804], []byte{1, 2, 3, 4}) {
+		t.Error("sector outside the image was erased")
+	}
+
+	if err := stlink.WriteFlash(f, 0x08000ffe, data); err == nil {
+		t.Error("WriteFlash past the end of flash succeeded")
+	}
+}
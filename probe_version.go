@@ -0,0 +1,163 @@
+package stlink
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// ProbeVersion is the hardware and firmware version of a probe
+type ProbeVersion struct {
+	// Stlink is the hardware version, 1 for a V1, 2 for a V2 or V2-1
+	// and 3 for a V3
+	Stlink uint8
+	// JTAG is the version of the JTAG/SWD firmware
+	JTAG uint8
+	// SWIM is the version of the SWIM firmware, a V2-1 has no SWIM
+	SWIM uint8
+	// MSD is the mass-storage firmware version, only reported by the
+	// V2-1 and V3
+	MSD uint8
+	// Bridge is the bridge firmware version, only reported by the V3
+	Bridge uint8
+	// VID and PID are the USB IDs reported by the probe
+	VID gousb.ID
+	PID gousb.ID
+}
+
+func (v ProbeVersion) String() string {
+	if v.Stlink >= 3 {
+		return fmt.Sprintf("V%dJ%dM%dB%dS%d", v.Stlink, v.JTAG, v.MSD, v.Bridge, v.SWIM)
+	}
+	if v.v21() {
+		return fmt.Sprintf("V%dJ%dM%d", v.Stlink, v.JTAG, v.MSD)
+	}
+	return fmt.Sprintf("V%dJ%dS%d", v.Stlink, v.JTAG, v.SWIM)
+}
+
+// v21 reports whether the probe is a V2-1, whose GET_VERSION reports
+// the MSD version where the V1 and V2 report the SWIM version
+func (v ProbeVersion) v21() bool {
+	return v.PID == StlinkV21PID || v.PID == StlinkV21NoMSDPID
+}
+
+// Capabilities is a set of features of the probe firmware
+type Capabilities uint32
+
+const (
+	// CapabilityAPIV2 is the JTAG API v2, next to the v1 API of the
+	// first V1 firmwares
+	CapabilityAPIV2 Capabilities = 1 << iota
+	// CapabilityAPIV3 marks a V3, which only has the API v2 variants of
+	// the commands and sets its clock with the COM frequency table
+	CapabilityAPIV3
+	// CapabilitySWDFreq is setting the SWD clock speed
+	CapabilitySWDFreq
+	// CapabilityJTAGFreq is setting the JTAG clock speed
+	CapabilityJTAGFreq
+	// CapabilityTrace is SWO trace capturing
+	CapabilityTrace
+	// CapabilityLastRWStatus2 is GETLASTRWSTATUS2, which also reports the
+	// faulting address
+	CapabilityLastRWStatus2
+	// CapabilityAPSelect is selecting the access port of memory
+	// transfers and accessing DAP registers
+	CapabilityAPSelect
+	// CapabilityMem16 is 16-bit memory transfers
+	CapabilityMem16
+	// CapabilityMultiAP is using access ports other than AP0
+	CapabilityMultiAP
+	// CapabilityBulkWrite8 is 8-bit memory transfers of up to 512 bytes,
+	// older firmware is limited to 64 bytes
+	CapabilityBulkWrite8
+)
+
+var capabilityNames = []string{
+	"api-v2",
+	"api-v3",
+	"swd-freq",
+	"jtag-freq",
+	"trace",
+	"last-rw-status2",
+	"ap-select",
+	"mem16",
+	"multi-ap",
+	"bulk-write8",
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Has reports whether all capabilities in o are in c
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+// Capabilities returns the features of the firmware version v
+func (v ProbeVersion) Capabilities() Capabilities {
+	var c Capabilities
+	switch {
+	case v.Stlink == 1:
+		if v.JTAG >= 11 {
+			c |= CapabilityAPIV2
+		}
+	case v.Stlink == 2:
+		c |= CapabilityAPIV2
+		if v.JTAG >= 13 {
+			c |= CapabilityTrace
+		}
+		if v.JTAG >= 15 {
+			c |= CapabilityLastRWStatus2
+		}
+		if v.JTAG >= 22 {
+			c |= CapabilitySWDFreq
+		}
+		if v.JTAG >= 24 {
+			c |= CapabilityJTAGFreq | CapabilityAPSelect
+		}
+		if v.JTAG >= 26 {
+			c |= CapabilityMem16
+		}
+		if v.JTAG >= 28 {
+			c |= CapabilityMultiAP
+		}
+	case v.Stlink >= 3:
+		c |= CapabilityAPIV2 | CapabilityAPIV3 | CapabilitySWDFreq |
+			CapabilityJTAGFreq | CapabilityTrace | CapabilityLastRWStatus2 |
+			CapabilityAPSelect | CapabilityMem16
+		if v.JTAG >= 2 {
+			c |= CapabilityMultiAP
+		}
+		if v.JTAG >= 6 {
+			c |= CapabilityBulkWrite8
+		}
+	}
+	return c
+}
+
+// ProbeVersion reads the version of the probe
+func (d *Device) ProbeVersion() (ProbeVersion, error) {
+	return d.readVersion()
+}
+
+// Capabilities returns the features of the probe firmware, as read when
+// the device was opened
+func (d *Device) Capabilities() Capabilities {
+	return d.caps
+}
+
+// require returns an error when the firmware misses a capability of c
+func (d *Device) require(c Capabilities) error {
+	if d.caps.Has(c) {
+		return nil
+	}
+	return fmt.Errorf("firmware %s does not support %s", d.version, c&^d.caps)
+}
@@ -0,0 +1,294 @@
+package stlink
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// A recording is a stream of JSON objects, one per line, each describing
+// a single transfer between the host and a probe.
+
+const (
+	recordOpen    = "open"
+	recordCommand = "cmd"
+	recordData    = "data"
+	recordReceive = "recv"
+	recordClose   = "close"
+
+	recordEpOut = "out"
+	recordEpIn  = "in"
+)
+
+type recordEvent struct {
+	Time     time.Time `json:"time"`
+	Serial   string    `json:"serial"`
+	PID      gousb.ID  `json:"pid,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Kind     string    `json:"kind"`
+	Endpoint string    `json:"ep,omitempty"`
+	Data     string    `json:"data,omitempty"`
+	Err      string    `json:"err,omitempty"`
+	// ErrKind names the sentinel error Err wraps, see recordErrKinds
+	ErrKind string `json:"errkind,omitempty"`
+}
+
+// recordErrKinds are the errors the Device acts on, they keep their
+// identity through a recording
+var recordErrKinds = []struct {
+	kind string
+	err  error
+}{
+	{"disconnected", ErrDisconnected},
+	{"deadline", context.DeadlineExceeded},
+	{"canceled", context.Canceled},
+}
+
+// recordKey is the key of the sessions of a probe, probes may share a
+// serial number
+func recordKey(serial, path string) string {
+	if path == "" {
+		return serial
+	}
+	return serial + "@" + path
+}
+
+// replayedError is a recorded error, it wraps the sentinel error it
+// wrapped when recorded
+type replayedError struct {
+	msg string
+	err error
+}
+
+func (e *replayedError) Error() string {
+	return e.msg
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.err
+}
+
+// recordSink serializes events of all recorded devices to one writer
+type recordSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (s *recordSink) log(ev recordEvent) {
+	ev.Time = time.Now()
+	s.mu.Lock()
+	// A recording is best-effort, it should never break the session itself
+	s.enc.Encode(ev)
+	s.mu.Unlock()
+}
+
+// Record makes every device opened through s from now on record its USB
+// traffic to w. Use NewReplayBackend to play a recording back.
+func (s *Stlink) Record(w io.Writer) {
+	s.recorder = &recordSink{enc: json.NewEncoder(w)}
+}
+
+// recordingTransport is a Transport logging all traffic going through it
+type recordingTransport struct {
+	t    Transport
+	sink *recordSink
+	info ProbeInfo
+}
+
+func newRecordingTransport(t Transport, info ProbeInfo, sink *recordSink) *recordingTransport {
+	sink.log(recordEvent{
+		Serial: info.SerialNumber,
+		PID:    info.PID,
+		Path:   info.Path,
+		Kind:   recordOpen,
+	})
+	return &recordingTransport{
+		t:    t,
+		sink: sink,
+		info: info,
+	}
+}
+
+func (r *recordingTransport) log(kind, ep string, b []byte, err error) {
+	ev := recordEvent{
+		Serial:   r.info.SerialNumber,
+		Path:     r.info.Path,
+		Kind:     kind,
+		Endpoint: ep,
+		Data:     hex.EncodeToString(b),
+	}
+	if err != nil {
+		ev.Err = err.Error()
+		for _, k := range recordErrKinds {
+			if errors.Is(err, k.err) {
+				ev.ErrKind = k.kind
+				break
+			}
+		}
+	}
+	r.sink.log(ev)
+}
+
+func (r *recordingTransport) SendCommand(ctx context.Context, cmd []byte) error {
+	err := r.t.SendCommand(ctx, cmd)
+	r.log(recordCommand, recordEpOut, cmd, err)
+	return err
+}
+
+func (r *recordingTransport) SendData(ctx context.Context, data []byte) error {
+	err := r.t.SendData(ctx, data)
+	r.log(recordData, recordEpOut, data, err)
+	return err
+}
+
+func (r *recordingTransport) Receive(ctx context.Context, n int) ([]byte, error) {
+	b, err := r.t.Receive(ctx, n)
+	r.log(recordReceive, recordEpIn, b, err)
+	return b, err
+}
+
+func (r *recordingTransport) Close() error {
+	err := r.t.Close()
+	r.log(recordClose, "", nil, err)
+	return err
+}
+
+// replayBackend is a Backend playing back a recording
+type replayBackend struct {
+	probes []ProbeInfo
+	events map[string][]recordEvent
+}
+
+// NewReplayBackend creates a Backend which plays back a recording made
+// with Stlink.Record. Every probe opened in the recording can be opened
+// again, after which the device must issue exactly the same commands
+// as recorded; it receives the recorded responses and errors.
+func NewReplayBackend(r io.Reader) (Backend, error) {
+	b := &replayBackend{
+		events: map[string][]recordEvent{},
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var ev recordEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("invalid recording: %v", err)
+		}
+		key := recordKey(ev.Serial, ev.Path)
+		if ev.Kind == recordOpen {
+			if _, ok := b.events[key]; !ok {
+				b.probes = append(b.probes, ProbeInfo{
+					PID:          ev.PID,
+					SerialNumber: ev.Serial,
+					Path:         ev.Path,
+				})
+			}
+		}
+		b.events[key] = append(b.events[key], ev)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *replayBackend) Probes() ([]ProbeInfo, error) {
+	return b.probes, nil
+}
+
+func (b *replayBackend) Open(p ProbeInfo) (Transport, error) {
+	key := recordKey(p.SerialNumber, p.Path)
+	evs := b.events[key]
+	if len(evs) == 0 || evs[0].Kind != recordOpen {
+		return nil, errors.New("device not found")
+	}
+	// Consume this session only, a second Open replays the next
+	// session of the same probe
+	n := 1
+	for n < len(evs) && evs[n].Kind != recordOpen {
+		n++
+	}
+	b.events[key] = evs[n:]
+	return &replayTransport{events: evs[1:n]}, nil
+}
+
+func (b *replayBackend) Close() error {
+	return nil
+}
+
+// replayTransport is the Transport of a single replayed session
+type replayTransport struct {
+	events []recordEvent
+}
+
+// next pops the next event which must be of the given kind, for sent
+// data the recorded data must match as well
+func (r *replayTransport) next(kind string, sent []byte) ([]byte, error) {
+	if len(r.events) == 0 {
+		return nil, errors.New("replay: end of recording")
+	}
+	ev := r.events[0]
+	if ev.Kind != kind {
+		return nil, fmt.Errorf("replay: expected %s, recording has %s", kind, ev.Kind)
+	}
+	data, err := hex.DecodeString(ev.Data)
+	if err != nil {
+		return nil, fmt.Errorf("replay: invalid data: %v", err)
+	}
+	if sent != nil && hex.EncodeToString(sent) != ev.Data {
+		return nil, fmt.Errorf("replay: sent % x, recording has % x", sent, data)
+	}
+	r.events = r.events[1:]
+	if ev.Err != "" {
+		return data, replayError(ev)
+	}
+	return data, nil
+}
+
+// replayError rebuilds the recorded error of ev
+func replayError(ev recordEvent) error {
+	for _, k := range recordErrKinds {
+		if k.kind == ev.ErrKind {
+			return &replayedError{msg: ev.Err, err: k.err}
+		}
+	}
+	return errors.New(ev.Err)
+}
+
+func (r *replayTransport) SendCommand(ctx context.Context, cmd []byte) error {
+	_, err := r.next(recordCommand, cmd)
+	return err
+}
+
+func (r *replayTransport) SendData(ctx context.Context, data []byte) error {
+	_, err := r.next(recordData, data)
+	return err
+}
+
+func (r *replayTransport) Receive(ctx context.Context, n int) ([]byte, error) {
+	data, err := r.next(recordReceive, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	copy(b, data)
+	return b, nil
+}
+
+func (r *replayTransport) Close() error {
+	if len(r.events) > 0 && r.events[0].Kind == recordClose {
+		r.events = r.events[1:]
+	}
+	return nil
+}
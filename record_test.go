@@ -0,0 +1,84 @@
+package stlink_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestRecordReplay(t *testing.T) {
+	run := func(s *stlink.Stlink, bus *sim.Bus, p1, p2 *sim.Probe) []error {
+		var errs []error
+		// clones sharing a serial number, told apart by their path
+		d1, err := s.OpenDevice("", stlink.OpenOptions{Path: "1-1"})
+		if err != nil {
+			t.Fatalf("OpenDevice 1-1: %v", err)
+		}
+		d2, err := s.OpenDevice("", stlink.OpenOptions{Path: "1-2"})
+		if err != nil {
+			t.Fatalf("OpenDevice 1-2: %v", err)
+		}
+		v, err := d2.Read32(0xe000ed00)
+		if err != nil || v != 0x410fc241 {
+			t.Errorf("CPUID of the second probe = %08x, %v", v, err)
+		}
+		if err := d1.WriteMem(0x20000000, []byte("recorded")); err != nil {
+			t.Fatalf("WriteMem: %v", err)
+		}
+
+		d1.SetTimeout(20 * time.Millisecond)
+		if p1 != nil {
+			p1.Hang = true
+		}
+		_, err = d1.Read32(0x20000000)
+		errs = append(errs, err)
+		if p1 != nil {
+			p1.Hang = false
+		}
+		buf := make([]byte, 8)
+		if err := d1.ReadMem(0x20000000, buf); err != nil || string(buf) != "recorded" {
+			t.Errorf("ReadMem after a timeout = %q, %v", buf, err)
+		}
+
+		if bus != nil {
+			bus.Unplug(p2)
+		}
+		_, err = d2.Read32(0x20000000)
+		errs = append(errs, err)
+		d1.Close()
+		d2.Close()
+		return errs
+	}
+
+	p1 := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F103xB))
+	p2 := sim.NewProbe("0123456789ab", sim.NewTarget(sim.STM32F407xG))
+	bus := sim.NewBus(p1, p2)
+	s := stlink.NewWithBackend(bus)
+	var rec bytes.Buffer
+	s.Record(&rec)
+	recorded := run(s, bus, p1, p2)
+
+	b, err := stlink.NewReplayBackend(bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReplayBackend: %v", err)
+	}
+	probes, _ := b.Probes()
+	if len(probes) != 2 || probes[0].Path != "1-1" || probes[1].Path != "1-2" {
+		t.Fatalf("replayed probes %+v", probes)
+	}
+	replayed := run(stlink.NewWithBackend(b), nil, nil, nil)
+
+	for i, errs := range [][]error{recorded, replayed} {
+		if !errors.Is(errs[0], context.DeadlineExceeded) {
+			t.Errorf("%d: Read32 of a hanging probe: %v", i, errs[0])
+		}
+		if !errors.Is(errs[1], stlink.ErrDisconnected) {
+			t.Errorf("%d: Read32 of an unplugged probe: %v", i, errs[1])
+		}
+	}
+}
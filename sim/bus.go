@@ -0,0 +1,103 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rikvdh/go-stlink"
+)
+
+// Bus is a stlink.Backend with simulated probes attached to it
+type Bus struct {
+	mu     sync.Mutex
+	probes []*Probe
+	ports  int
+}
+
+// NewBus creates a bus with probes attached
+func NewBus(probes ...*Probe) *Bus {
+	b := &Bus{}
+	for _, p := range probes {
+		b.attach(p)
+	}
+	return b
+}
+
+// attach adds p to the bus, a probe without path gets the next free port
+func (b *Bus) attach(p *Probe) {
+	if p.Path == "" {
+		b.ports++
+		p.Path = fmt.Sprintf("1-%d", b.ports)
+	}
+	b.probes = append(b.probes, p)
+}
+
+// Probes lists the attached probes
+func (b *Bus) Probes() ([]stlink.ProbeInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var infos []stlink.ProbeInfo
+	for _, p := range b.probes {
+		infos = append(infos, stlink.ProbeInfo{
+			PID:          p.PID,
+			SerialNumber: p.SerialNumber,
+			Path:         p.Path,
+			Manufacturer: p.Manufacturer,
+			Product:      p.Product,
+		})
+	}
+	return infos, nil
+}
+
+// Open opens the probe described by info
+func (b *Bus) Open(info stlink.ProbeInfo) (stlink.Transport, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range b.probes {
+		if p.PID != info.PID || p.SerialNumber != info.SerialNumber {
+			continue
+		}
+		if info.Path != "" && p.Path != info.Path {
+			continue
+		}
+		if p.opened {
+			return nil, errors.New("sim: probe busy")
+		}
+		p.opened = true
+		return p, nil
+	}
+	return nil, errors.New("sim: device not found")
+}
+
+// Plug attaches p to the bus, like a freshly plugged-in probe it
+// starts in DFU mode
+func (b *Bus) Plug(p *Probe) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.unplugged = false
+	p.opened = false
+	p.rx = nil
+	p.wrLen = 0
+	p.Mode = stlink.StlinkModeDfu
+	b.attach(p)
+}
+
+// Unplug removes p from the bus, every transfer of an open session
+// fails with an error wrapping stlink.ErrDisconnected
+func (b *Bus) Unplug(p *Probe) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, q := range b.probes {
+		if q == p {
+			b.probes = append(b.probes[:i], b.probes[i+1:]...)
+			break
+		}
+	}
+	p.unplugged = true
+}
+
+// Close closes the bus
+func (b *Bus) Close() error {
+	return nil
+}
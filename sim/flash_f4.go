@@ -0,0 +1,240 @@
+package sim
+
+// Flash interface register offsets and bits of the STM32F2, F4 and F7,
+// see flash_stm32fs.go in the stlink package
+const (
+	f4FlashRegBase uint32 = 0x40023c00
+	f4FlashBase    uint32 = 0x08000000
+
+	f4KEYR = 0x04
+	f4SR   = 0x0c
+	f4CR   = 0x10
+
+	f4SREOP    = 1 << 0
+	f4SROpErr  = 1 << 1
+	f4SRWrpErr = 1 << 4
+	f4SRPgaErr = 1 << 5
+	f4SRPgpErr = 1 << 6
+	f4SRPgsErr = 1 << 7
+	f4SRBusy   = 1 << 16
+
+	f4CRPG     = 1 << 0
+	f4CRSER    = 1 << 1
+	f4CRMER    = 1 << 2
+	f4CRMER1   = 1 << 15
+	f4CRStrt   = 1 << 16
+	f4CRLock   = 1 << 31
+	f4SNBBank2 = 0x10
+	// f4Bank2Sector is the index of the first sector of bank 2
+	f4Bank2Sector = 12
+)
+
+// FlashF4 emulates the flash interface of a STM32F2, F4 or F7 together
+// with the flash it controls
+type FlashF4 struct {
+	// Mem is the contents of the flash
+	Mem []byte
+	// Sectors are the sector sizes in address order
+	Sectors []uint32
+	// DualBank numbers the sectors from 12 on as bank 2 sectors
+	DualBank bool
+	// Protected are the write protected sectors, by index
+	Protected map[int]bool
+	// BusyPolls is the number of status reads which report busy after
+	// every operation
+	BusyPolls int
+	// Erased lists the indexes of the erased sectors
+	Erased []int
+	// WriteSizes counts the program accesses by their size in bytes
+	WriteSizes map[int]int
+
+	keys     int
+	keyError bool
+	sr       uint32
+	cr       uint32
+	busy     int
+}
+
+// NewFlashF4 creates an erased flash with sectors of the given sizes
+func NewFlashF4(sectors ...uint32) *FlashF4 {
+	var size uint32
+	for _, s := range sectors {
+		size += s
+	}
+	f := &FlashF4{
+		Mem:        make([]byte, size),
+		Sectors:    sectors,
+		Protected:  map[int]bool{},
+		WriteSizes: map[int]int{},
+		cr:         f4CRLock,
+	}
+	for i := range f.Mem {
+		f.Mem[i] = 0xff
+	}
+	return f
+}
+
+// Map maps the registers and the flash of f into t
+func (f *FlashF4) Map(t *Target) {
+	t.Map(f4FlashRegBase, 0x400, f4Regs{f})
+	t.Map(f4FlashBase, uint32(len(f.Mem)), f4Array{f})
+}
+
+// Locked reports whether the flash is locked
+func (f *FlashF4) Locked() bool {
+	return f.cr&f4CRLock != 0
+}
+
+// psize returns the program parallelism in bytes set in CR
+func (f *FlashF4) psize() int {
+	return 1 << (f.cr >> 8 & 3)
+}
+
+func (f *FlashF4) done(status uint32) {
+	f.sr |= status
+	f.busy = f.BusyPolls
+}
+
+// sector returns the index of the sector numbered snb
+func (f *FlashF4) sector(snb uint32) (int, bool) {
+	i := int(snb)
+	if f.DualBank && snb&f4SNBBank2 != 0 {
+		i = f4Bank2Sector + int(snb&^f4SNBBank2)
+	} else if f.DualBank && i >= f4Bank2Sector {
+		return 0, false
+	}
+	return i, i < len(f.Sectors)
+}
+
+// offset returns the offset of sector i in the flash
+func (f *FlashF4) offset(i int) uint32 {
+	var off uint32
+	for _, s := range f.Sectors[:i] {
+		off += s
+	}
+	return off
+}
+
+func (f *FlashF4) erase(first, n int) {
+	for i := first; i < first+n; i++ {
+		if f.Protected[i] {
+			f.done(f4SRWrpErr)
+			return
+		}
+	}
+	for i := first; i < first+n; i++ {
+		off := f.offset(i)
+		for j := off; j < off+f.Sectors[i]; j++ {
+			f.Mem[j] = 0xff
+		}
+		f.Erased = append(f.Erased, i)
+	}
+	f.done(f4SREOP)
+}
+
+// f4Regs are the flash interface registers
+type f4Regs struct {
+	f *FlashF4
+}
+
+func (r f4Regs) Read(off uint32, size int) uint32 {
+	f := r.f
+	switch off {
+	case f4SR:
+		if f.busy > 0 {
+			f.busy--
+			return f.sr | f4SRBusy
+		}
+		return f.sr
+	case f4CR:
+		return f.cr
+	}
+	return 0
+}
+
+func (r f4Regs) Write(off uint32, size int, v uint32) {
+	f := r.f
+	switch off {
+	case f4KEYR:
+		switch {
+		case f.keyError:
+		case f.keys == 0 && v == fpecKey1:
+			f.keys = 1
+		case f.keys == 1 && v == fpecKey2:
+			f.keys = 0
+			f.cr &^= f4CRLock
+		default:
+			// locked until reset
+			f.keyError = true
+		}
+	case f4SR:
+		f.sr &^= v & (f4SREOP | f4SROpErr | f4SRWrpErr | f4SRPgaErr | f4SRPgpErr | f4SRPgsErr)
+	case f4CR:
+		if f.Locked() {
+			return
+		}
+		f.cr = v &^ f4CRStrt
+		if v&f4CRStrt == 0 {
+			return
+		}
+		switch {
+		case v&(f4CRMER|f4CRMER1) != 0:
+			f.erase(0, len(f.Sectors))
+		case v&f4CRSER != 0:
+			i, ok := f.sector(v >> 3 & 0x1f)
+			if !ok {
+				f.done(f4SROpErr)
+				return
+			}
+			f.erase(i, 1)
+		}
+	}
+}
+
+// f4Array is the flash, it is programmed while PG is set with accesses
+// of the size set by PSIZE. Double words are written as two words.
+type f4Array struct {
+	f *FlashF4
+}
+
+func (a f4Array) Read(off uint32, size int) uint32 {
+	var v uint32
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint32(a.f.Mem[off+uint32(i)])
+	}
+	return v
+}
+
+func (a f4Array) Write(off uint32, size int, v uint32) {
+	f := a.f
+	psize := f.psize()
+	if psize == 8 {
+		psize = 4
+	}
+	switch {
+	case f.Locked() || f.cr&f4CRPG == 0:
+		f.done(f4SRPgsErr)
+		return
+	case size != psize:
+		f.done(f4SRPgpErr)
+		return
+	case off%uint32(size) != 0:
+		f.done(f4SRPgaErr)
+		return
+	}
+	i, start := 0, uint32(0)
+	for i < len(f.Sectors) && off >= start+f.Sectors[i] {
+		start += f.Sectors[i]
+		i++
+	}
+	if f.Protected[i] {
+		f.done(f4SRWrpErr)
+		return
+	}
+	f.WriteSizes[size]++
+	for j := 0; j < size; j++ {
+		// programming can only clear bits
+		f.Mem[off+uint32(j)] &= byte(v >> (8 * uint(j)))
+	}
+	f.done(f4SREOP)
+}
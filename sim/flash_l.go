@@ -0,0 +1,273 @@
+package sim
+
+// Flash interface register offsets and bits of the STM32L0 and L1, see
+// flash_stm32l.go in the stlink package
+const (
+	l0FlashRegBase uint32 = 0x40022000
+	l1FlashRegBase uint32 = 0x40023c00
+	lFlashBase     uint32 = 0x08000000
+	lEEPROMBase    uint32 = 0x08080000
+
+	lPECR    = 0x04
+	lPEKEYR  = 0x0c
+	lPRGKEYR = 0x10
+	lSR      = 0x18
+
+	lPEKey1  = 0x89abcdef
+	lPEKey2  = 0x02030405
+	lPRGKey1 = 0x8c9daebf
+	lPRGKey2 = 0x13141516
+
+	lPECRPELock  = 1 << 0
+	lPECRPrgLock = 1 << 1
+	lPECRProg    = 1 << 3
+	lPECRData    = 1 << 4
+	lPECRErase   = 1 << 9
+	lPECRFPrg    = 1 << 10
+
+	lSRBusy   = 1 << 0
+	lSREOP    = 1 << 1
+	lSRReady  = 1 << 3
+	lSRWrpErr = 1 << 8
+	lSRPgaErr = 1 << 9
+	lSRSizErr = 1 << 10
+)
+
+// FlashL emulates the flash interface of a STM32L0 or L1 together with
+// the program flash and data EEPROM it controls
+type FlashL struct {
+	// Mem is the contents of the program flash
+	Mem []byte
+	// EEPROM is the contents of the data EEPROM
+	EEPROM []byte
+	// PageSize is the size of an erase page, programming is done in
+	// half-pages
+	PageSize uint32
+	// Protected are the write protected pages
+	Protected map[int]bool
+	// BusyPolls is the number of status reads which report busy after
+	// every operation
+	BusyPolls int
+	// Erases counts the page erases
+	Erases int
+	// HalfPages counts the half-pages programmed
+	HalfPages int
+
+	regs     uint32
+	keys     int
+	prgKeys  int
+	keyError bool
+	sr       uint32
+	pecr     uint32
+	busy     int
+	// half-page being loaded, and the number of words in it so far
+	half  uint32
+	words int
+}
+
+// NewFlashL0 creates the erased flash of size bytes and EEPROM of eeprom
+// bytes of a STM32L0
+func NewFlashL0(size, eeprom uint32) *FlashL {
+	return newFlashL(l0FlashRegBase, 128, size, eeprom)
+}
+
+// NewFlashL1 creates the erased flash of size bytes and EEPROM of eeprom
+// bytes of a STM32L1
+func NewFlashL1(size, eeprom uint32) *FlashL {
+	return newFlashL(l1FlashRegBase, 256, size, eeprom)
+}
+
+func newFlashL(regs, pageSize, size, eeprom uint32) *FlashL {
+	return &FlashL{
+		Mem:       make([]byte, size),
+		EEPROM:    make([]byte, eeprom),
+		PageSize:  pageSize,
+		Protected: map[int]bool{},
+		regs:      regs,
+		pecr:      lPECRPELock | lPECRPrgLock,
+	}
+}
+
+// Map maps the registers, the flash and the EEPROM of f into t
+func (f *FlashL) Map(t *Target) {
+	t.Map(f.regs, 0x400, lRegs{f})
+	t.Map(lFlashBase, uint32(len(f.Mem)), lArray{f})
+	t.Map(lEEPROMBase, uint32(len(f.EEPROM)), lEEPROM{f})
+}
+
+// Locked reports whether the flash is locked
+func (f *FlashL) Locked() bool {
+	return f.pecr&(lPECRPELock|lPECRPrgLock) != 0
+}
+
+func (f *FlashL) done(status uint32) {
+	f.sr |= status
+	f.busy = f.BusyPolls
+}
+
+// lRegs are the flash interface registers
+type lRegs struct {
+	f *FlashL
+}
+
+func (r lRegs) Read(off uint32, size int) uint32 {
+	f := r.f
+	switch off {
+	case lPECR:
+		return f.pecr
+	case lSR:
+		if f.busy > 0 {
+			f.busy--
+			return f.sr | lSRBusy
+		}
+		return f.sr | lSRReady
+	}
+	return 0
+}
+
+func (r lRegs) Write(off uint32, size int, v uint32) {
+	f := r.f
+	switch off {
+	case lPEKEYR:
+		switch {
+		case f.keyError:
+		case f.keys == 0 && v == lPEKey1:
+			f.keys = 1
+		case f.keys == 1 && v == lPEKey2:
+			f.keys = 0
+			f.pecr &^= lPECRPELock
+		default:
+			// locked until reset
+			f.keyError = true
+		}
+	case lPRGKEYR:
+		switch {
+		case f.keyError:
+		case f.pecr&lPECRPELock != 0:
+			f.keyError = true
+		case f.prgKeys == 0 && v == lPRGKey1:
+			f.prgKeys = 1
+		case f.prgKeys == 1 && v == lPRGKey2:
+			f.prgKeys = 0
+			f.pecr &^= lPECRPrgLock
+		default:
+			f.keyError = true
+		}
+	case lSR:
+		f.sr &^= v & (lSREOP | lSRWrpErr | lSRPgaErr | lSRSizErr)
+	case lPECR:
+		if f.pecr&lPECRPELock != 0 {
+			return
+		}
+		// the lock bits are only cleared by the keys, PELOCK sets both
+		locks := f.pecr & lPECRPrgLock
+		if v&lPECRPELock != 0 {
+			locks = lPECRPELock | lPECRPrgLock
+		} else if v&lPECRPrgLock != 0 {
+			locks = lPECRPrgLock
+		}
+		f.pecr = v&(lPECRProg|lPECRData|lPECRErase|lPECRFPrg) | locks
+		f.words = 0
+	}
+}
+
+// lArray is the program flash. A write erases the page with ERASE and
+// PROG set, loads a half-page with PROG and FPRG set and programs a word
+// otherwise.
+type lArray struct {
+	f *FlashL
+}
+
+func (a lArray) Read(off uint32, size int) uint32 {
+	return readBytes(a.f.Mem, off, size)
+}
+
+func (a lArray) Write(off uint32, size int, v uint32) {
+	f := a.f
+	switch {
+	case f.Locked():
+		f.done(lSRWrpErr)
+		return
+	case size != 4 || off%4 != 0:
+		f.done(lSRSizErr)
+		return
+	case f.Protected[int(off/f.PageSize)]:
+		f.done(lSRWrpErr)
+		return
+	}
+	switch mode := f.pecr & (lPECRProg | lPECRData | lPECRErase | lPECRFPrg); mode {
+	case lPECRErase | lPECRProg:
+		start := off - off%f.PageSize
+		for i := start; i < start+f.PageSize; i++ {
+			f.Mem[i] = 0
+		}
+		f.Erases++
+		f.done(lSREOP)
+	case lPECRProg | lPECRFPrg:
+		half := f.PageSize / 2
+		if f.words == 0 {
+			f.half = off - off%half
+		}
+		if off != f.half+uint32(f.words)*4 {
+			f.words = 0
+			f.done(lSRPgaErr)
+			return
+		}
+		writeBytes(f.Mem, off, 4, v)
+		f.words++
+		if uint32(f.words)*4 == half {
+			f.words = 0
+			f.HalfPages++
+			f.done(lSREOP)
+		}
+	case 0:
+		writeBytes(f.Mem, off, 4, v)
+		f.done(lSREOP)
+	default:
+		f.done(lSRPgaErr)
+	}
+}
+
+// lEEPROM is the data EEPROM, it is written in bytes, half-words or words
+// while PECR is unlocked. A word write with ERASE and DATA set erases it.
+type lEEPROM struct {
+	f *FlashL
+}
+
+func (e lEEPROM) Read(off uint32, size int) uint32 {
+	return readBytes(e.f.EEPROM, off, size)
+}
+
+func (e lEEPROM) Write(off uint32, size int, v uint32) {
+	f := e.f
+	switch {
+	case f.pecr&lPECRPELock != 0:
+		f.done(lSRWrpErr)
+	case off%uint32(size) != 0:
+		f.done(lSRSizErr)
+	case f.pecr&lPECRErase != 0:
+		if f.pecr&lPECRData == 0 || size != 4 {
+			f.done(lSRSizErr)
+			return
+		}
+		writeBytes(f.EEPROM, off, 4, 0)
+		f.done(lSREOP)
+	default:
+		writeBytes(f.EEPROM, off, size, v)
+		f.done(lSREOP)
+	}
+}
+
+func readBytes(mem []byte, off uint32, size int) uint32 {
+	var v uint32
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint32(mem[off+uint32(i)])
+	}
+	return v
+}
+
+func writeBytes(mem []byte, off uint32, size int, v uint32) {
+	for i := 0; i < size; i++ {
+		mem[off+uint32(i)] = byte(v >> (8 * uint(i)))
+	}
+}
@@ -0,0 +1,261 @@
+package sim
+
+// FPEC register offsets and bits, see flash_stm32fp.go in the stlink
+// package
+const (
+	fpecRegBase   uint32 = 0x40022000
+	fpecFlashBase uint32 = 0x08000000
+
+	fpecKEYR = 0x04
+	fpecSR   = 0x0c
+	fpecCR   = 0x10
+	fpecAR   = 0x14
+	// fpecBank2 is the offset of the bank 2 registers of XL-density
+	// parts, KEYR2 is at fpecBank2+fpecKEYR
+	fpecBank2 = 0x40
+
+	fpecKey1 = 0x45670123
+	fpecKey2 = 0xcdef89ab
+
+	fpecSRBusy     = 1 << 0
+	fpecSRPgErr    = 1 << 2
+	fpecSRWrPrtErr = 1 << 4
+	fpecSREOP      = 1 << 5
+
+	fpecCRPG   = 1 << 0
+	fpecCRPER  = 1 << 1
+	fpecCRMER  = 1 << 2
+	fpecCRStrt = 1 << 6
+	fpecCRLock = 1 << 7
+
+	// fpecBankSize is the size of bank 1 of a dual bank flash
+	fpecBankSize = 512 * 1024
+)
+
+// FPEC emulates the flash program and erase controller of a STM32F0, F1
+// or F3 together with the flash it controls. A flash larger than 512KB
+// has a second bank with its own registers, like the XL-density STM32F1.
+type FPEC struct {
+	// Mem is the contents of the flash
+	Mem []byte
+	// PageSize is the size of an erase page
+	PageSize uint32
+	// Protected are the write protected pages
+	Protected map[int]bool
+	// BusyPolls is the number of status reads which report busy after
+	// every operation
+	BusyPolls int
+	// Erases counts the page and mass erases
+	Erases int
+	// NoEOP makes operations end without setting EOP, like a write
+	// that never reached the FPEC
+	NoEOP bool
+
+	banks []*fpecBank
+}
+
+// fpecBank is the state of the registers of a bank
+type fpecBank struct {
+	f *FPEC
+	// first page and number of pages of the bank
+	first, n int
+
+	keys     int
+	keyError bool
+	sr       uint32
+	cr       uint32
+	ar       uint32
+	busy     int
+}
+
+// NewFPEC creates an erased flash of size bytes with pages of pageSize
+// bytes
+func NewFPEC(size, pageSize uint32) *FPEC {
+	f := &FPEC{
+		Mem:       make([]byte, size),
+		PageSize:  pageSize,
+		Protected: map[int]bool{},
+	}
+	for i := range f.Mem {
+		f.Mem[i] = 0xff
+	}
+	pages := int(size / pageSize)
+	if size <= fpecBankSize {
+		f.banks = []*fpecBank{{f: f, n: pages}}
+	} else {
+		split := int(fpecBankSize / pageSize)
+		f.banks = []*fpecBank{
+			{f: f, n: split},
+			{f: f, first: split, n: pages - split},
+		}
+	}
+	for _, b := range f.banks {
+		b.cr = fpecCRLock
+	}
+	return f
+}
+
+// Map maps the registers and the flash of f into t
+func (f *FPEC) Map(t *Target) {
+	t.Map(fpecRegBase, 0x400, fpecRegs{f})
+	t.Map(fpecFlashBase, uint32(len(f.Mem)), fpecArray{f})
+}
+
+// Locked reports whether any bank of the flash is locked
+func (f *FPEC) Locked() bool {
+	for _, b := range f.banks {
+		if b.cr&fpecCRLock != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bank returns the bank holding page
+func (f *FPEC) bank(page int) *fpecBank {
+	for _, b := range f.banks {
+		if page >= b.first && page < b.first+b.n {
+			return b
+		}
+	}
+	return f.banks[0]
+}
+
+func (b *fpecBank) locked() bool {
+	return b.cr&fpecCRLock != 0
+}
+
+func (b *fpecBank) done(status uint32) {
+	if b.f.NoEOP {
+		status &^= fpecSREOP
+	}
+	b.sr |= status
+	b.busy = b.f.BusyPolls
+}
+
+func (b *fpecBank) erase(first, n int) {
+	f := b.f
+	f.Erases++
+	for page := first; page < first+n; page++ {
+		if f.Protected[page] {
+			b.done(fpecSRWrPrtErr)
+			return
+		}
+	}
+	start := uint32(first) * f.PageSize
+	for i := start; i < start+uint32(n)*f.PageSize; i++ {
+		f.Mem[i] = 0xff
+	}
+	b.done(fpecSREOP)
+}
+
+// fpecRegs are the FPEC registers
+type fpecRegs struct {
+	f *FPEC
+}
+
+// bank returns the bank of the register at off and its offset within
+// the register set of the bank
+func (r fpecRegs) bank(off uint32) (*fpecBank, uint32) {
+	if off >= fpecBank2 && off < 2*fpecBank2 && len(r.f.banks) > 1 {
+		return r.f.banks[1], off - fpecBank2
+	}
+	return r.f.banks[0], off
+}
+
+func (r fpecRegs) Read(off uint32, size int) uint32 {
+	b, off := r.bank(off)
+	switch off {
+	case fpecSR:
+		if b.busy > 0 {
+			b.busy--
+			return b.sr | fpecSRBusy
+		}
+		return b.sr
+	case fpecCR:
+		return b.cr
+	case fpecAR:
+		return b.ar
+	}
+	return 0
+}
+
+func (r fpecRegs) Write(off uint32, size int, v uint32) {
+	b, off := r.bank(off)
+	f := r.f
+	switch off {
+	case fpecKEYR:
+		switch {
+		case b.keyError:
+		case b.keys == 0 && v == fpecKey1:
+			b.keys = 1
+		case b.keys == 1 && v == fpecKey2:
+			b.keys = 0
+			b.cr &^= fpecCRLock
+		default:
+			// locked until reset
+			b.keyError = true
+		}
+	case fpecSR:
+		b.sr &^= v & (fpecSRPgErr | fpecSRWrPrtErr | fpecSREOP)
+	case fpecCR:
+		if b.locked() {
+			return
+		}
+		b.cr = v & (fpecCRPG | fpecCRPER | fpecCRMER | fpecCRStrt | fpecCRLock)
+		if v&fpecCRStrt == 0 {
+			return
+		}
+		b.cr &^= fpecCRStrt
+		switch {
+		case v&fpecCRMER != 0:
+			b.erase(b.first, b.n)
+		case v&fpecCRPER != 0:
+			off := b.ar - fpecFlashBase
+			if off >= uint32(len(f.Mem)) || f.bank(int(off/f.PageSize)) != b {
+				// a page of the other bank
+				return
+			}
+			b.erase(int(off/f.PageSize), 1)
+		}
+	case fpecAR:
+		b.ar = v
+	}
+}
+
+// fpecArray is the flash, it is programmed with half-word writes while
+// PG is set in the control register of its bank
+type fpecArray struct {
+	f *FPEC
+}
+
+func (a fpecArray) Read(off uint32, size int) uint32 {
+	var v uint32
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint32(a.f.Mem[off+uint32(i)])
+	}
+	return v
+}
+
+func (a fpecArray) Write(off uint32, size int, v uint32) {
+	f := a.f
+	page := int(off / f.PageSize)
+	b := f.bank(page)
+	if b.locked() || b.cr&fpecCRPG == 0 || size != 2 || off%2 != 0 {
+		b.done(fpecSRPgErr)
+		return
+	}
+	if f.Protected[page] {
+		b.done(fpecSRWrPrtErr)
+		return
+	}
+	// Only an erased half-word can be programmed, except with zero
+	old := uint32(f.Mem[off]) | uint32(f.Mem[off+1])<<8
+	if old != 0xffff && v != 0 {
+		b.done(fpecSRPgErr)
+		return
+	}
+	f.Mem[off] = byte(v)
+	f.Mem[off+1] = byte(v >> 8)
+	b.done(fpecSREOP)
+}
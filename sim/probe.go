@@ -0,0 +1,601 @@
+// Package sim implements an in-process ST-link probe with a simulated
+// Cortex-M target behind it, so the stlink package can be exercised
+// without any hardware attached.
+package sim
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gousb"
+	"github.com/rikvdh/go-stlink"
+)
+
+// opcodes as sent over the wire, see commands.go in the stlink package
+const (
+	cmdGetVersion       = 0xf1
+	cmdDebug            = 0xf2
+	cmdDfu              = 0xf3
+	cmdDfuExit          = 0x07
+	cmdGetCurrentMode   = 0xf5
+	cmdGetTargetVoltage = 0xf7
+	cmdGetVersionEx     = 0xfb
+
+	cmdDebugGetStatus           = 0x01
+	cmdDebugForce               = 0x02
+	cmdDebugResetsys            = 0x03
+	cmdDebugAPIV1ReadAllRegs    = 0x04
+	cmdDebugAPIV1ReadReg        = 0x05
+	cmdDebugAPIV1WriteReg       = 0x06
+	cmdDebugReadMem32           = 0x07
+	cmdDebugWriteMem32          = 0x08
+	cmdDebugRunCore             = 0x09
+	cmdDebugStepCore            = 0x0a
+	cmdDebugReadMem8            = 0x0c
+	cmdDebugWriteMem8           = 0x0d
+	cmdDebugEnterMode           = 0x20
+	cmdDebugExit                = 0x21
+	cmdDebugReadCoreid          = 0x22
+	cmdDebugReadReg             = 0x33
+	cmdDebugWriteReg            = 0x34
+	cmdDebugJtagWritedebug32bit = 0x35
+	cmdDebugJtagReaddebug32bit  = 0x36
+	cmdDebugReadAllRegs         = 0x3a
+	cmdDebugGetLastRWStatus     = 0x3b
+	cmdDebugGetLastRWStatus2    = 0x3e
+	cmdDebugReadMem16           = 0x47
+	cmdDebugWriteMem16          = 0x48
+	cmdDebugHardReset           = 0x3c
+	cmdDebugSwdSetFreq          = 0x43
+	cmdDebugJtagSetFreq         = 0x44
+	cmdDebugAPIV2EnterMode      = 0x30
+	cmdDebugAPIV2ReadIDCodes    = 0x31
+	cmdDebugAPIV2Resetsys       = 0x32
+	cmdDebugAPIV3SetComFreq     = 0x61
+	cmdDebugAPIV3GetComFreq     = 0x62
+
+	debugEnterJtag = 0x00
+	debugEnterSwd  = 0xa3
+
+	statusOK      = 0x80
+	statusRunning = 0x80
+	statusHalted  = 0x81
+	statusAPFault = 0x11
+	statusDPError = 0x16
+)
+
+const (
+	stVID = 0x0483
+	v1PID = 0x3744
+)
+
+var (
+	// ErrClosed is returned when a closed probe is used
+	ErrClosed = errors.New("sim: probe closed")
+	// ErrUnplugged is returned when an unplugged probe is used
+	ErrUnplugged = fmt.Errorf("sim: %w", stlink.ErrDisconnected)
+)
+
+// Probe is a simulated ST-link probe, it implements stlink.Transport
+type Probe struct {
+	PID          gousb.ID
+	SerialNumber string
+	// Path is the USB location of the probe, set by the Bus when empty
+	Path         string
+	Manufacturer string
+	Product      string
+
+	// Firmware version reported by the probe
+	StlinkVersion uint8
+	JTAGVersion   uint8
+	SWIMVersion   uint8
+	// MSDVersion is only reported by a V2-1 and V3, BridgeVersion only
+	// by a V3
+	MSDVersion    uint8
+	BridgeVersion uint8
+
+	// Voltage is the reported target voltage
+	Voltage float32
+	// Mode is the current mode of the probe
+	Mode stlink.StlinkMode
+	// CoreID is the reported debug port IDCODE
+	CoreID uint32
+	// Interface is the debug interface entered last
+	Interface stlink.DebugInterface
+	// ClockDivider is the last divider set with SWD_SET_FREQ or JTAG_SET_FREQ
+	ClockDivider uint16
+	// SWDFrequencies and JTAGFrequencies are the clock speeds in kHz a V3
+	// reports, ClockKHz is the last one set with SET_COM_FREQ
+	SWDFrequencies  []uint32
+	JTAGFrequencies []uint32
+	ClockKHz        uint32
+	// Target is the simulated chip attached to the probe
+	Target *Target
+	// Hang makes the probe stop answering, Receive blocks until its
+	// context is done
+	Hang bool
+
+	opened    bool
+	unplugged bool
+	// targetLost makes debug commands fail until the debug mode is
+	// entered again
+	targetLost bool
+	rx         [][]byte
+	// pending data phase of a memory write, in accesses of wrSize bytes
+	wrAddr uint32
+	wrLen  int
+	wrSize int
+	// status of the last memory transfer
+	rwStatus byte
+	rwAddr   uint32
+}
+
+// NewProbe creates a simulated ST-link V2 in DFU mode, like a freshly
+// plugged-in probe, with target t attached
+func NewProbe(serial string, t *Target) *Probe {
+	return &Probe{
+		PID:           stlink.StlinkV2PID,
+		SerialNumber:  serial,
+		Manufacturer:  "STMicroelectronics",
+		Product:       "STM32 STLink",
+		StlinkVersion: 2,
+		JTAGVersion:   28,
+		SWIMVersion:   7,
+		Voltage:       3.3,
+		Mode:          stlink.StlinkModeDfu,
+		CoreID:        0x1ba01477,
+		Target:        t,
+	}
+}
+
+// NewProbeV21 creates a simulated ST-link V2-1, as found on Nucleo
+// boards, in DFU mode with target t attached
+func NewProbeV21(serial string, t *Target) *Probe {
+	p := NewProbe(serial, t)
+	p.PID = stlink.StlinkV21PID
+	p.JTAGVersion = 37
+	p.SWIMVersion = 0
+	p.MSDVersion = 26
+	return p
+}
+
+// NewProbeV3 creates a simulated STLINK-V3 in DFU mode with target t
+// attached
+func NewProbeV3(serial string, t *Target) *Probe {
+	return &Probe{
+		PID:             stlink.StlinkV3PID,
+		SerialNumber:    serial,
+		Manufacturer:    "STMicroelectronics",
+		Product:         "STLINK-V3",
+		StlinkVersion:   3,
+		JTAGVersion:     7,
+		SWIMVersion:     1,
+		MSDVersion:      3,
+		BridgeVersion:   3,
+		Voltage:         3.3,
+		Mode:            stlink.StlinkModeDfu,
+		CoreID:          0x2ba01477,
+		SWDFrequencies:  []uint32{24000, 8000, 3300, 1000, 200, 50, 5},
+		JTAGFrequencies: []uint32{21333, 16000, 12000, 8000, 4000, 1000},
+		Target:          t,
+	}
+}
+
+// NewProbeV1 creates a simulated ST-link V1 in DFU mode with target t
+// attached. With jtag below 11 its firmware only has the API v1.
+func NewProbeV1(serial string, jtag uint8, t *Target) *Probe {
+	return &Probe{
+		PID:           v1PID,
+		SerialNumber:  serial,
+		Manufacturer:  "STMicroelectronics",
+		Product:       "STM32 STLink",
+		StlinkVersion: 1,
+		JTAGVersion:   jtag,
+		Voltage:       3.3,
+		Mode:          stlink.StlinkModeDfu,
+		CoreID:        0x1ba01477,
+		Target:        t,
+	}
+}
+
+// apiV2 reports whether the firmware has the JTAG API v2
+func (p *Probe) apiV2() bool {
+	return p.StlinkVersion >= 2 || p.JTAGVersion >= 11
+}
+
+// v3 reports whether the probe only supports the API v2/v3 commands
+func (p *Probe) v3() bool {
+	return p.StlinkVersion >= 3
+}
+
+func (p *Probe) respond(b []byte) {
+	p.rx = append(p.rx, b)
+}
+
+func (p *Probe) respond32(vals ...uint32) {
+	b := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+	p.respond(b)
+}
+
+// SendCommand decodes and executes a command block
+func (p *Probe) SendCommand(ctx context.Context, cmd []byte) error {
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if len(cmd) < 2 {
+		return fmt.Errorf("sim: command too short: % x", cmd)
+	}
+	if p.wrLen > 0 {
+		return fmt.Errorf("sim: command while expecting %d bytes of data: % x", p.wrLen, cmd)
+	}
+	switch cmd[0] {
+	case cmdGetVersion:
+		b := make([]byte, 6)
+		b[0] = p.StlinkVersion<<4 | p.JTAGVersion>>2
+		low := p.SWIMVersion
+		if p.PID == stlink.StlinkV21PID || p.PID == stlink.StlinkV21NoMSDPID {
+			low = p.MSDVersion
+		}
+		b[1] = p.JTAGVersion<<6 | low&0x3f
+		binary.LittleEndian.PutUint16(b[2:], stVID)
+		binary.LittleEndian.PutUint16(b[4:], uint16(p.PID))
+		p.respond(b)
+	case cmdGetVersionEx:
+		if !p.v3() {
+			return fmt.Errorf("sim: unsupported command: % x", cmd)
+		}
+		b := make([]byte, 12)
+		b[0] = p.StlinkVersion
+		b[1] = p.SWIMVersion
+		b[2] = p.JTAGVersion
+		b[3] = p.MSDVersion
+		b[4] = p.BridgeVersion
+		binary.LittleEndian.PutUint16(b[8:], stVID)
+		binary.LittleEndian.PutUint16(b[10:], uint16(p.PID))
+		p.respond(b)
+	case cmdGetCurrentMode:
+		p.respond([]byte{byte(p.Mode), 0})
+	case cmdGetTargetVoltage:
+		// voltage = 2.4 * adc1 / adc0
+		p.respond32(2400, uint32(p.Voltage*1000+0.5))
+	case cmdDfu:
+		if cmd[1] != cmdDfuExit {
+			return fmt.Errorf("sim: unsupported DFU command: % x", cmd)
+		}
+		p.Mode = stlink.StlinkModeMass
+	case cmdDebug:
+		return p.debugCommand(cmd)
+	default:
+		return fmt.Errorf("sim: unsupported command: % x", cmd)
+	}
+	return nil
+}
+
+func (p *Probe) debugCommand(cmd []byte) error {
+	enter := cmd[1] == cmdDebugEnterMode || cmd[1] == cmdDebugAPIV2EnterMode
+	if !enter && p.Mode != stlink.StlinkModeDebug {
+		return fmt.Errorf("sim: debug command while not in debug mode: % x", cmd)
+	}
+	// The V3 dropped the API v1 variants of these commands
+	switch cmd[1] {
+	case cmdDebugEnterMode, cmdDebugReadCoreid, cmdDebugResetsys,
+		cmdDebugSwdSetFreq, cmdDebugJtagSetFreq:
+		if p.v3() {
+			return fmt.Errorf("sim: API v1 command on a V3: % x", cmd)
+		}
+	case cmdDebugAPIV3SetComFreq, cmdDebugAPIV3GetComFreq:
+		if !p.v3() {
+			return fmt.Errorf("sim: V3 command on a V2: % x", cmd)
+		}
+	case cmdDebugReadMem16, cmdDebugWriteMem16:
+		if p.StlinkVersion < 2 || (p.StlinkVersion == 2 && p.JTAGVersion < 26) {
+			return fmt.Errorf("sim: 16-bit transfers need J26 or later: % x", cmd)
+		}
+	case cmdDebugAPIV1ReadAllRegs, cmdDebugAPIV1ReadReg, cmdDebugAPIV1WriteReg:
+		if p.v3() {
+			return fmt.Errorf("sim: API v1 command on a V3: % x", cmd)
+		}
+	case cmdDebugReadAllRegs, cmdDebugReadReg, cmdDebugWriteReg, cmdDebugJtagReaddebug32bit,
+		cmdDebugJtagWritedebug32bit, cmdDebugHardReset, cmdDebugAPIV2ReadIDCodes:
+		if !p.apiV2() {
+			return fmt.Errorf("sim: API v2 command on API v1 firmware: % x", cmd)
+		}
+	}
+	if p.targetLost {
+		switch cmd[1] {
+		case cmdDebugForce, cmdDebugStepCore, cmdDebugRunCore, cmdDebugResetsys,
+			cmdDebugAPIV2Resetsys, cmdDebugReadReg, cmdDebugWriteReg, cmdDebugReadAllRegs,
+			cmdDebugJtagReaddebug32bit, cmdDebugJtagWritedebug32bit:
+			// the status comes first, the rest is zero padded
+			p.respond([]byte{statusDPError})
+			return nil
+		}
+	}
+	t := p.Target
+	switch cmd[1] {
+	case cmdDebugEnterMode, cmdDebugAPIV2EnterMode:
+		switch cmd[2] {
+		case debugEnterSwd:
+			p.Interface = stlink.DebugInterfaceSWD
+		case debugEnterJtag:
+			p.Interface = stlink.DebugInterfaceJTAG
+		default:
+			return fmt.Errorf("sim: unsupported debug interface: % x", cmd)
+		}
+		p.Mode = stlink.StlinkModeDebug
+		p.targetLost = false
+		if cmd[1] == cmdDebugAPIV2EnterMode {
+			p.respond([]byte{statusOK, 0})
+		}
+	case cmdDebugExit:
+		p.Mode = stlink.StlinkModeMass
+	case cmdDebugGetStatus:
+		if t.Halted {
+			p.respond([]byte{statusHalted, 0})
+		} else {
+			p.respond([]byte{statusRunning, 0})
+		}
+	case cmdDebugForce, cmdDebugStepCore:
+		if !t.Halted {
+			t.Halts++
+		}
+		t.Halted = true
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugRunCore:
+		t.Halted = false
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugResetsys, cmdDebugAPIV2Resetsys, cmdDebugHardReset:
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugReadCoreid:
+		p.respond32(p.CoreID)
+	case cmdDebugAPIV2ReadIDCodes:
+		p.respond32(statusOK, p.CoreID, 0)
+	case cmdDebugReadMem8, cmdDebugReadMem16, cmdDebugReadMem32:
+		if len(cmd) < 8 {
+			return fmt.Errorf("sim: command too short: % x", cmd)
+		}
+		addr := binary.LittleEndian.Uint32(cmd[2:])
+		n := int(binary.LittleEndian.Uint16(cmd[6:]))
+		size := memAccessSize(cmd[1])
+		if addr%uint32(size) != 0 || n%size != 0 {
+			return fmt.Errorf("sim: unaligned %d-bit read: % x", 8*size, cmd)
+		}
+		b := make([]byte, n)
+		for i := 0; i < n; i += size {
+			v := t.Read(addr+uint32(i), size)
+			for j := 0; j < size; j++ {
+				b[i+j] = byte(v >> (8 * uint(j)))
+			}
+		}
+		p.setRWStatus(addr, n)
+		// A single byte read returns 2 bytes
+		if n == 1 {
+			b = append(b, 0)
+		}
+		p.respond(b)
+	case cmdDebugWriteMem8, cmdDebugWriteMem16, cmdDebugWriteMem32:
+		if len(cmd) < 8 {
+			return fmt.Errorf("sim: command too short: % x", cmd)
+		}
+		addr := binary.LittleEndian.Uint32(cmd[2:])
+		n := int(binary.LittleEndian.Uint16(cmd[6:]))
+		size := memAccessSize(cmd[1])
+		if addr%uint32(size) != 0 || n%size != 0 {
+			return fmt.Errorf("sim: unaligned %d-bit write: % x", 8*size, cmd)
+		}
+		p.wrAddr, p.wrLen, p.wrSize = addr, n, size
+	case cmdDebugGetLastRWStatus:
+		p.respond([]byte{p.rwStatus, 0})
+	case cmdDebugGetLastRWStatus2:
+		if p.StlinkVersion < 2 || (p.StlinkVersion == 2 && p.JTAGVersion < 15) {
+			return fmt.Errorf("sim: unsupported debug command: % x", cmd)
+		}
+		p.respond32(uint32(p.rwStatus), p.rwAddr, 0)
+	case cmdDebugAPIV1ReadReg:
+		if len(cmd) < 3 || int(cmd[2]) >= len(t.Regs) {
+			return fmt.Errorf("sim: invalid register read: % x", cmd)
+		}
+		p.respond32(t.Regs[cmd[2]])
+	case cmdDebugAPIV1WriteReg:
+		if len(cmd) < 7 || int(cmd[2]) >= len(t.Regs) {
+			return fmt.Errorf("sim: invalid register write: % x", cmd)
+		}
+		t.Regs[cmd[2]] = binary.LittleEndian.Uint32(cmd[3:])
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugAPIV1ReadAllRegs:
+		// like READALLREGS of the API v2, without status
+		p.respond32(append(t.Regs[:0x13:0x13], 0, 0)...)
+	case cmdDebugReadReg:
+		if len(cmd) < 3 || int(cmd[2]) >= len(t.Regs) {
+			return fmt.Errorf("sim: invalid register read: % x", cmd)
+		}
+		p.respond32(statusOK, t.Regs[cmd[2]])
+	case cmdDebugWriteReg:
+		if len(cmd) < 7 || int(cmd[2]) >= len(t.Regs) {
+			return fmt.Errorf("sim: invalid register write: % x", cmd)
+		}
+		t.Regs[cmd[2]] = binary.LittleEndian.Uint32(cmd[3:])
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugReadAllRegs:
+		// r0-r15, xpsr, msp, psp and two reserved words
+		vals := []uint32{statusOK}
+		vals = append(vals, t.Regs[:0x13]...)
+		p.respond32(append(vals, 0, 0)...)
+	case cmdDebugSwdSetFreq, cmdDebugJtagSetFreq:
+		if (cmd[1] == cmdDebugSwdSetFreq) != (p.Interface == stlink.DebugInterfaceSWD) {
+			return fmt.Errorf("sim: clock command for the wrong interface: % x", cmd)
+		}
+		p.ClockDivider = binary.LittleEndian.Uint16(cmd[2:])
+		p.respond([]byte{statusOK, 0})
+	case cmdDebugAPIV3GetComFreq:
+		freqs := p.frequencies(cmd[2])
+		if freqs == nil {
+			return fmt.Errorf("sim: unsupported interface: % x", cmd)
+		}
+		b := make([]byte, 52)
+		b[0] = statusOK
+		b[8] = byte(len(freqs))
+		for i, f := range freqs {
+			binary.LittleEndian.PutUint32(b[12+4*i:], f)
+		}
+		p.respond(b)
+	case cmdDebugAPIV3SetComFreq:
+		if len(cmd) < 8 {
+			return fmt.Errorf("sim: command too short: % x", cmd)
+		}
+		freq := binary.LittleEndian.Uint32(cmd[4:])
+		found := false
+		for _, f := range p.frequencies(cmd[2]) {
+			found = found || f == freq
+		}
+		if !found {
+			return fmt.Errorf("sim: unsupported frequency %d kHz: % x", freq, cmd)
+		}
+		p.ClockKHz = freq
+		p.respond32(statusOK, freq)
+	case cmdDebugJtagReaddebug32bit:
+		if len(cmd) < 6 {
+			return fmt.Errorf("sim: command too short: % x", cmd)
+		}
+		addr := binary.LittleEndian.Uint32(cmd[2:])
+		if t.faulting(addr, 4) {
+			p.respond32(statusAPFault, 0)
+			break
+		}
+		p.respond32(statusOK, t.Read(addr, 4))
+	case cmdDebugJtagWritedebug32bit:
+		if len(cmd) < 10 {
+			return fmt.Errorf("sim: command too short: % x", cmd)
+		}
+		addr := binary.LittleEndian.Uint32(cmd[2:])
+		if t.faulting(addr, 4) {
+			p.respond([]byte{statusAPFault, 0})
+			break
+		}
+		t.Write(addr, 4, binary.LittleEndian.Uint32(cmd[6:]))
+		p.respond([]byte{statusOK, 0})
+	default:
+		return fmt.Errorf("sim: unsupported debug command: % x", cmd)
+	}
+	return nil
+}
+
+// memAccessSize returns the access width in bytes of a memory command
+func memAccessSize(cmd byte) int {
+	switch cmd {
+	case cmdDebugReadMem16, cmdDebugWriteMem16:
+		return 2
+	case cmdDebugReadMem32, cmdDebugWriteMem32:
+		return 4
+	}
+	return 1
+}
+
+// setRWStatus sets the status of a memory transfer of n bytes at addr
+func (p *Probe) setRWStatus(addr uint32, n int) {
+	p.rwStatus, p.rwAddr = statusOK, 0
+	if p.targetLost {
+		p.rwStatus = statusDPError
+		return
+	}
+	for i := 0; i < n; i++ {
+		if p.Target.faulting(addr+uint32(i), 1) {
+			p.rwStatus, p.rwAddr = statusAPFault, addr+uint32(i)
+			return
+		}
+	}
+}
+
+// frequencies returns the V3 clock speeds of interface mode, 0 for SWD
+// and 1 for JTAG
+func (p *Probe) frequencies(mode byte) []uint32 {
+	switch mode {
+	case 0:
+		return p.SWDFrequencies
+	case 1:
+		return p.JTAGFrequencies
+	}
+	return nil
+}
+
+// SendData receives the data phase of a memory write
+func (p *Probe) SendData(ctx context.Context, data []byte) error {
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if len(data) != p.wrLen {
+		return fmt.Errorf("sim: got %d bytes of data, expected %d", len(data), p.wrLen)
+	}
+	p.setRWStatus(p.wrAddr, len(data))
+	if p.rwStatus != statusDPError {
+		// the accesses before a fault are done
+		for i := 0; i < len(data); i += p.wrSize {
+			if p.rwStatus == statusAPFault && p.wrAddr+uint32(i+p.wrSize) > p.rwAddr {
+				break
+			}
+			var v uint32
+			for j := p.wrSize - 1; j >= 0; j-- {
+				v = v<<8 | uint32(data[i+j])
+			}
+			p.Target.Write(p.wrAddr+uint32(i), p.wrSize, v)
+		}
+	}
+	p.wrLen = 0
+	return nil
+}
+
+// Receive returns the oldest pending response. Like a USB bulk read a
+// shorter response is zero padded, a longer one is returned in parts.
+func (p *Probe) Receive(ctx context.Context, n int) ([]byte, error) {
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+	if p.Hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if len(p.rx) == 0 {
+		return nil, errors.New("sim: no response pending")
+	}
+	b := make([]byte, n)
+	c := copy(b, p.rx[0])
+	if c < len(p.rx[0]) {
+		p.rx[0] = p.rx[0][c:]
+	} else {
+		p.rx = p.rx[1:]
+	}
+	return b, nil
+}
+
+func (p *Probe) usable() error {
+	if p.unplugged {
+		return ErrUnplugged
+	}
+	if !p.opened {
+		return ErrClosed
+	}
+	return nil
+}
+
+// LoseTarget simulates a target reset or brown-out: the core runs and
+// debug commands fail with a DP error until the debug mode is entered
+// again
+func (p *Probe) LoseTarget() {
+	p.targetLost = true
+	p.Target.Halted = false
+}
+
+// Close closes the probe, it can be opened again through its Bus
+func (p *Probe) Close() error {
+	if !p.opened {
+		return ErrClosed
+	}
+	p.opened = false
+	p.rx = nil
+	return nil
+}
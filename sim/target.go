@@ -0,0 +1,258 @@
+package sim
+
+// Peripheral emulates a memory mapped register block of a target.
+// Offsets are relative to the base address the peripheral is mapped at,
+// size is the access width in bytes (1, 2 or 4).
+type Peripheral interface {
+	Read(offset uint32, size int) uint32
+	Write(offset uint32, size int, v uint32)
+}
+
+type mapping struct {
+	base, size uint32
+	p          Peripheral
+}
+
+// TargetConfig describes the identification registers of a simulated target
+type TargetConfig struct {
+	// CPUID is the value of the Cortex-M CPUID register
+	CPUID uint32
+	// IDCode is the value of the DBGMCU IDCODE register at IDCodeAddress
+	IDCode        uint32
+	IDCodeAddress uint32
+	// FlashSize is the value of the flash size register at
+	// FlashSizeAddress, the size in KB on most parts
+	FlashSize        uint16
+	FlashSizeAddress uint32
+	// FPU adds a floating point unit to a Cortex-M4 or M7
+	FPU bool
+}
+
+var (
+	// STM32F103xB is a medium-density STM32F1 (Cortex-M3) with 128KB flash
+	STM32F103xB = TargetConfig{
+		CPUID:            0x411fc231,
+		IDCode:           0x20036410,
+		IDCodeAddress:    0xe0042000,
+		FlashSize:        128,
+		FlashSizeAddress: 0x1ffff7e0,
+	}
+	// STM32F103xG is a XL-density STM32F1 with 1MB flash in two banks
+	STM32F103xG = TargetConfig{
+		CPUID:            0x411fc231,
+		IDCode:           0x10016430,
+		IDCodeAddress:    0xe0042000,
+		FlashSize:        1024,
+		FlashSizeAddress: 0x1ffff7e0,
+	}
+	// STM32F072xB is a STM32F0 (Cortex-M0) with 128KB flash
+	STM32F072xB = TargetConfig{
+		CPUID:            0x410cc200,
+		IDCode:           0x20006448,
+		IDCodeAddress:    0x40015800,
+		FlashSize:        128,
+		FlashSizeAddress: 0x1ffff7cc,
+	}
+	// STM32F407xG is a STM32F4 (Cortex-M4) with 1MB flash
+	STM32F407xG = TargetConfig{
+		CPUID:            0x410fc241,
+		IDCode:           0x10076413,
+		IDCodeAddress:    0xe0042000,
+		FlashSize:        1024,
+		FlashSizeAddress: 0x1fff7a22,
+		FPU:              true,
+	}
+	// STM32L053x8 is a STM32L0 (Cortex-M0+) with 64KB flash and 2KB
+	// data EEPROM
+	STM32L053x8 = TargetConfig{
+		CPUID:            0x410cc601,
+		IDCode:           0x10086417,
+		IDCodeAddress:    0x40015800,
+		FlashSize:        64,
+		FlashSizeAddress: 0x1ff8007c,
+	}
+	// STM32L152xD is a cat.4 STM32L1 with 384KB flash and 12KB data
+	// EEPROM, its flash size register only holds 1 for 384KB
+	STM32L152xD = TargetConfig{
+		CPUID:            0x412fc231,
+		IDCode:           0x10086436,
+		IDCodeAddress:    0xe0042000,
+		FlashSize:        1,
+		FlashSizeAddress: 0x1ff800cc,
+	}
+	// STM32L152xE is a STM32L1 (Cortex-M3) with 512KB flash and 16KB
+	// data EEPROM
+	STM32L152xE = TargetConfig{
+		CPUID:            0x412fc231,
+		IDCode:           0x10186437,
+		IDCodeAddress:    0xe0042000,
+		FlashSize:        512,
+		FlashSizeAddress: 0x1ff800cc,
+	}
+)
+
+const (
+	cpuIDAddress     uint32 = 0xe000ed00
+	coreDebugAddress uint32 = 0xe000edf0
+	mvfr0Address     uint32 = 0xe000ef40
+)
+
+// Target is a simulated Cortex-M target with a sparse memory map.
+// Unwritten memory reads as zero.
+type Target struct {
+	// Halted is the run state of the core
+	Halted bool
+	// IgnoreHalt makes the core ignore halt requests through DHCSR
+	IgnoreHalt bool
+	// Halts counts the halts of a running core
+	Halts int
+	// Regs are the core registers, indexed by their DCRSR register selector
+	Regs [0x60]uint32
+
+	mem         map[uint32]byte
+	peripherals []mapping
+	faults      []mapping
+}
+
+// NewTarget creates a target with its identification registers set from cfg
+func NewTarget(cfg TargetConfig) *Target {
+	t := &Target{
+		mem: map[uint32]byte{},
+	}
+	t.Write(cpuIDAddress, 4, cfg.CPUID)
+	t.Write(cfg.IDCodeAddress, 4, cfg.IDCode)
+	t.Write(cfg.FlashSizeAddress, 2, uint32(cfg.FlashSize))
+	if cfg.FPU {
+		t.Write(mvfr0Address, 4, 0x10110021)
+	}
+	t.Map(coreDebugAddress, 0x10, &coreDebug{t: t})
+	return t
+}
+
+// Map maps peripheral p at [base, base+size), accesses to that range
+// are handled by p instead of the plain memory. A later mapping takes
+// precedence over earlier ones.
+func (t *Target) Map(base, size uint32, p Peripheral) {
+	t.peripherals = append([]mapping{{base: base, size: size, p: p}}, t.peripherals...)
+}
+
+// MapFault makes accesses to [base, base+size) fail with a bus fault
+func (t *Target) MapFault(base, size uint32) {
+	t.faults = append(t.faults, mapping{base: base, size: size})
+}
+
+func (t *Target) faulting(addr uint32, size int) bool {
+	for _, m := range t.faults {
+		end := uint64(addr) + uint64(size)
+		if end > uint64(m.base) && uint64(addr) < uint64(m.base)+uint64(m.size) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Target) peripheral(addr uint32) (Peripheral, uint32) {
+	for _, m := range t.peripherals {
+		if addr >= m.base && addr-m.base < m.size {
+			return m.p, addr - m.base
+		}
+	}
+	return nil, 0
+}
+
+// Read reads a little-endian value of size bytes from addr
+func (t *Target) Read(addr uint32, size int) uint32 {
+	if p, off := t.peripheral(addr); p != nil {
+		return p.Read(off, size)
+	}
+	var v uint32
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint32(t.mem[addr+uint32(i)])
+	}
+	return v
+}
+
+// Write writes a little-endian value of size bytes to addr
+func (t *Target) Write(addr uint32, size int, v uint32) {
+	if p, off := t.peripheral(addr); p != nil {
+		p.Write(off, size, v)
+		return
+	}
+	for i := 0; i < size; i++ {
+		t.mem[addr+uint32(i)] = byte(v >> (8 * uint(i)))
+	}
+}
+
+// coreDebug emulates the DHCSR, DCRSR, DCRDR and DEMCR registers
+type coreDebug struct {
+	t     *Target
+	dhcsr uint32
+	dcrdr uint32
+	demcr uint32
+	// pending is a DCRSR transfer requested while the core was running,
+	// it never completes
+	pending bool
+}
+
+const (
+	dhcsrKey     = 0xa05f0000
+	dhcsrDebugEn = 0x00000001
+	dhcsrHalt    = 0x00000002
+	dhcsrRegRdy  = 0x00010000
+	dhcsrSHalt   = 0x00020000
+	dcrsrWrite   = 0x00010000
+)
+
+func (c *coreDebug) Read(off uint32, size int) uint32 {
+	switch off {
+	case 0x0:
+		v := c.dhcsr & 0xffff
+		if !c.pending {
+			v |= dhcsrRegRdy
+		}
+		if c.t.Halted {
+			v |= dhcsrSHalt
+		}
+		return v
+	case 0x8:
+		return c.dcrdr
+	case 0xc:
+		return c.demcr
+	}
+	return 0
+}
+
+func (c *coreDebug) Write(off uint32, size int, v uint32) {
+	switch off {
+	case 0x0:
+		if v&0xffff0000 != dhcsrKey {
+			return
+		}
+		c.dhcsr = v & 0xffff
+		if v&dhcsrDebugEn != 0 && (v&dhcsrHalt == 0 || !c.t.IgnoreHalt) {
+			if v&dhcsrHalt != 0 && !c.t.Halted {
+				c.t.Halts++
+			}
+			c.t.Halted = v&dhcsrHalt != 0
+		}
+	case 0x4:
+		sel := v & 0x7f
+		if int(sel) >= len(c.t.Regs) {
+			return
+		}
+		// register transfers only work on a halted core
+		c.pending = !c.t.Halted
+		if c.pending {
+			return
+		}
+		if v&dcrsrWrite != 0 {
+			c.t.Regs[sel] = c.dcrdr
+		} else {
+			c.dcrdr = c.t.Regs[sel]
+		}
+	case 0x8:
+		c.dcrdr = v
+	case 0xc:
+		c.demcr = v
+	}
+}
@@ -1,113 +1,240 @@
 package stlink
 
 import (
-	"encoding/hex"
-	"errors"
+	"fmt"
+	"time"
 
 	"github.com/google/gousb"
 )
 
 // Stlink context structure
 type Stlink struct {
-	usbctx *gousb.Context
+	backend  Backend
+	recorder *recordSink
 }
 
-// New creates a new Stlink context
+// New creates a new Stlink context using the USB bus
 func New() (*Stlink, error) {
-	s := &Stlink{
-		usbctx: gousb.NewContext(),
+	return NewWithBackend(newUSBBackend()), nil
+}
+
+// NewWithBackend creates a new Stlink context which finds its
+// probes through b instead of the USB bus
+func NewWithBackend(b Backend) *Stlink {
+	return &Stlink{
+		backend: b,
 	}
-	return s, nil
 }
 
 // Close closes the Slink context
 func (s *Stlink) Close() error {
-	return s.usbctx.Close()
+	return s.backend.Close()
 }
 
 const (
-	stVID        gousb.ID = 0x0483
-	stlinkV1PID  gousb.ID = 0x3744
-	StlinkV2PID  gousb.ID = 0x3748
-	StlinkV21PID gousb.ID = 0x374b
+	stVID             gousb.ID = 0x0483
+	stlinkV1PID       gousb.ID = 0x3744
+	StlinkV2PID       gousb.ID = 0x3748
+	StlinkV21PID      gousb.ID = 0x374b
+	StlinkV21NoMSDPID gousb.ID = 0x3752
+	StlinkV3EPID      gousb.ID = 0x374e
+	StlinkV3PID       gousb.ID = 0x374f
+	StlinkV32VCPPID   gousb.ID = 0x3753
+	StlinkV3NoMSDPID  gousb.ID = 0x3754
+	StlinkV3PwrPID    gousb.ID = 0x3757
 )
 
-func (s *Stlink) probeAll() ([]*gousb.Device, error) {
-	return s.usbctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		if desc.Vendor == stVID && (desc.Product == StlinkV21PID || desc.Product == StlinkV2PID) {
-			return true
-		}
-		return false
-	})
+// supportedPID reports whether pid is an ST-link this package can use
+func supportedPID(pid gousb.ID) bool {
+	switch pid {
+	case stlinkV1PID, StlinkV2PID, StlinkV21PID, StlinkV21NoMSDPID, StlinkV3EPID,
+		StlinkV3PID, StlinkV3NoMSDPID, StlinkV32VCPPID, StlinkV3PwrPID:
+		return true
+	}
+	return false
+}
+
+// ProbeInfo describes an attached ST-link probe
+type ProbeInfo struct {
+	PID          gousb.ID
+	SerialNumber string
+	// Path is the physical USB location as bus-port.port..., like 1-4.2.
+	// It tells apart probes with the same serial number.
+	Path string
+	// Manufacturer and Product are the USB string descriptors
+	Manufacturer string
+	Product      string
+}
+
+// Backend gives access to the attached ST-link probes
+type Backend interface {
+	// Probes lists the attached probes
+	Probes() ([]ProbeInfo, error)
+	// Open opens a Transport to the probe described by p
+	Open(p ProbeInfo) (Transport, error)
+	// Close releases the backend
+	Close() error
 }
 
 // Probe searches for a list of devices and returns them.
 // returned devices don't need to be closed but can't be used either.
-// Use OpenDevice to open a device by SerialNumber
-func (s *Stlink) Probe() ([]Device, error) {
-	var devlist []Device
+// Use OpenDevice to open a device by SerialNumber.
+// Only the USB descriptors are read, Device.QueryProbe reads the
+// firmware version and target voltage of a probe on demand.
+func (s *Stlink) Probe() ([]*Device, error) {
+	var devlist []*Device
 
-	devs, err := s.probeAll()
+	probes, err := s.backend.Probes()
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		for _, d := range devs {
-			d.Close()
-		}
-	}()
-	for _, d := range devs {
-		// 3 is the iSerialNumber, no constant in gousb for this
-		sd, err := d.GetStringDescriptor(3)
-		if err != nil {
-			return nil, err
-		}
-		dev := Device{
-			PID:          d.Desc.Product,
-			SerialNumber: sd,
-			opened:       false,
+	for _, p := range probes {
+		dev := &Device{
+			opened: false,
 		}
-		// We check if the device ID is hex-encoded, otherwise do so
-		if _, err := hex.DecodeString(sd); err != nil {
-			dev.SerialNumber = hex.EncodeToString([]byte(sd))
+		dev.setProbeInfo(p)
+		p := p
+		dev.query = func() (ProbeVersion, float32, error) {
+			return s.query(p)
 		}
 		devlist = append(devlist, dev)
 	}
 	return devlist, nil
 }
 
+// query reads the firmware version and target voltage of probe p, the
+// probe is left in its current mode
+func (s *Stlink) query(p ProbeInfo) (ProbeVersion, float32, error) {
+	t, err := s.openTransport(p)
+	if err != nil {
+		return ProbeVersion{}, 0, err
+	}
+	d := &Device{
+		PID:     p.PID,
+		tr:      t,
+		opened:  true,
+		timeout: DefaultTimeout,
+	}
+	defer d.Close()
+	v, err := d.readVersion()
+	if err != nil {
+		return ProbeVersion{}, 0, err
+	}
+	voltage, err := d.TargetVoltage()
+	return v, voltage, err
+}
+
+// OpenOptions are the options for opening a device
+type OpenOptions struct {
+	// Interface is the debug interface to the target, SWD by default
+	Interface DebugInterface
+	// Timeout bounds every USB transfer, DefaultTimeout when zero
+	Timeout time.Duration
+	// AutoReconnect makes the device reconnect when the probe or target
+	// connection is lost, the failed command is tried once more
+	AutoReconnect bool
+	// OnReconnect is called after every reconnect attempt
+	OnReconnect func(ReconnectEvent)
+
+	// Path, Index and Match select the probe to open, on top of the
+	// serial number given to OpenDevice. A probe has to match all of
+	// them.
+	//
+	// Path selects the probe at a USB location, see ProbeInfo.Path
+	Path string
+	// Index selects the probe by its position in the Probe result
+	Index *int
+	// Match selects the probes for which it returns true
+	Match func(ProbeInfo) bool
+}
+
+// matches reports whether the probe p at index i is selected by o
+func (o *OpenOptions) matches(i int, p ProbeInfo) bool {
+	if o.Path != "" && p.Path != o.Path {
+		return false
+	}
+	if o.Index != nil && i != *o.Index {
+		return false
+	}
+	return o.Match == nil || o.Match(p)
+}
+
 // OpenDevice opens a device by serial number. Giving serial
-// as an empty string, OpenDevice takes the first ST-link
-// it can find
-func (s *Stlink) OpenDevice(serial string) (*Device, error) {
-	devs, err := s.probeAll()
+// as an empty string, OpenDevice takes any ST-link it can find.
+// At most one OpenOptions is used, it may narrow the selection
+// down further. When several probes match, an *AmbiguousError is
+// returned.
+func (s *Stlink) OpenDevice(serial string, opts ...OpenOptions) (*Device, error) {
+	var o OpenOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	probes, err := s.backend.Probes()
 	if err != nil {
 		return nil, err
 	}
-	for _, d := range devs {
-		// 3 is the iSerialNumber, no constant in gousb for this
-		sd, err := d.GetStringDescriptor(3)
-		if err != nil {
-			return nil, err
+	var found []ProbeInfo
+	for i, p := range probes {
+		if p.SerialNumber != serial && serial != "" {
+			continue
 		}
-		dev := &Device{
-			PID:         d.Desc.Product,
-			SerialNumber: sd,
-			dev:          d,
-			opened:       true,
+		if o.matches(i, p) {
+			found = append(found, p)
 		}
-		// We check if the device ID is hex-encoded, otherwise do so
-		if _, err := hex.DecodeString(sd); err != nil {
-			dev.SerialNumber = hex.EncodeToString([]byte(sd))
+	}
+	if len(found) == 0 {
+		return nil, ErrDeviceNotFound
+	}
+	if len(found) > 1 {
+		return nil, &AmbiguousError{Probes: found}
+	}
+	p := found[0]
+	t, err := s.openTransport(p)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := NewDevice(t, p.PID, o)
+	if err != nil {
+		return nil, err
+	}
+	dev.setProbeInfo(p)
+	dev.reopen = func() (Transport, error) {
+		return s.reopen(p)
+	}
+	return dev, nil
+}
+
+func (s *Stlink) openTransport(p ProbeInfo) (Transport, error) {
+	t, err := s.backend.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if s.recorder != nil {
+		t = newRecordingTransport(t, p, s.recorder)
+	}
+	return t, nil
+}
+
+// reopen opens the probe p again after it was lost, it may have been
+// enumerated anew in the meantime
+func (s *Stlink) reopen(p ProbeInfo) (Transport, error) {
+	probes, err := s.backend.Probes()
+	if err != nil {
+		return nil, err
+	}
+	// A probe which keeps its location is preferred, probes may share a
+	// serial number
+	var found *ProbeInfo
+	for i, q := range probes {
+		if q.PID != p.PID || q.SerialNumber != p.SerialNumber {
+			continue
 		}
-		if dev.SerialNumber == serial || serial == "" {
-			if err := dev.init(); err != nil {
-				dev.Close()
-				return nil, err
-			}
-			return dev, nil
+		if q.Path == p.Path || found == nil {
+			found = &probes[i]
 		}
-		dev.Close()
 	}
-	return nil, errors.New("device not found")
+	if found != nil {
+		return s.openTransport(*found)
+	}
+	return nil, fmt.Errorf("probe %s not found: %w", p.SerialNumber, ErrDisconnected)
 }
@@ -1,5 +1,9 @@
 package stlink
 
+import (
+	"strings"
+)
+
 //go:generate go run cmd/getpartlist/main.go
 
 type Target struct {
@@ -10,3 +14,19 @@ type Target struct {
 	EepromSize uint
 	SramSize   uint
 }
+
+// eepromSize returns the data EEPROM size in bytes of the parts with core
+// pn, a type starting with prefix and flashKB KB of flash. When those
+// parts differ it is the smallest of them.
+func eepromSize(pn CortexMPartNumber, prefix string, flashKB uint) uint {
+	var size uint
+	for _, t := range stmChips[pn] {
+		if !strings.HasPrefix(t.Type, prefix) || t.FlashSize != flashKB || t.EepromSize == 0 {
+			continue
+		}
+		if size == 0 || t.EepromSize < size {
+			size = t.EepromSize
+		}
+	}
+	return size
+}
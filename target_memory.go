@@ -0,0 +1,109 @@
+package stlink
+
+import (
+	"errors"
+	"io"
+)
+
+// addressSpaceSize is the size of the 32-bit address space of the target
+const addressSpaceSize int64 = 1 << 32
+
+// TargetMemory is a view of the 32-bit address space of the target, offsets
+// are target addresses. It implements io.Reader, io.Writer, io.Seeker,
+// io.ReaderAt and io.WriterAt.
+type TargetMemory struct {
+	d   *Device
+	off int64
+}
+
+// Memory returns a view of the target memory, positioned at address 0
+func (d *Device) Memory() *TargetMemory {
+	return &TargetMemory{d: d}
+}
+
+// clip limits n bytes at off to the address space, it returns io.EOF
+// when the range is cut short
+func clip(off int64, n int) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= addressSpaceSize {
+		return 0, io.EOF
+	}
+	if int64(n) > addressSpaceSize-off {
+		return int(addressSpaceSize - off), io.EOF
+	}
+	return n, nil
+}
+
+// done returns the number of bytes of a transfer at off which were done
+// before it failed with err
+func done(err error, off int64, n int) int {
+	var merr *MemoryError
+	if errors.As(err, &merr) && int64(merr.Addr) > off && int64(merr.Addr) < off+int64(n) {
+		return int(int64(merr.Addr) - off)
+	}
+	return 0
+}
+
+// ReadAt reads len(p) bytes of target memory at address off. On a bus
+// fault the bytes before the faulting address are read.
+func (m *TargetMemory) ReadAt(p []byte, off int64) (int, error) {
+	n, eof := clip(off, len(p))
+	if n == 0 {
+		return 0, eof
+	}
+	if err := m.d.ReadMem(uint32(off), p[:n]); err != nil {
+		return done(err, off, n), err
+	}
+	return n, eof
+}
+
+// WriteAt writes p to target memory at address off. On a bus fault the
+// bytes before the faulting address are written.
+func (m *TargetMemory) WriteAt(p []byte, off int64) (int, error) {
+	n, eof := clip(off, len(p))
+	if eof != nil {
+		eof = io.ErrShortWrite
+	}
+	if n == 0 {
+		return 0, eof
+	}
+	if err := m.d.WriteMem(uint32(off), p[:n]); err != nil {
+		return done(err, off, n), err
+	}
+	return n, eof
+}
+
+// Read reads target memory from the current position
+func (m *TargetMemory) Read(p []byte) (int, error) {
+	n, err := m.ReadAt(p, m.off)
+	m.off += int64(n)
+	return n, err
+}
+
+// Write writes target memory at the current position
+func (m *TargetMemory) Write(p []byte) (int, error) {
+	n, err := m.WriteAt(p, m.off)
+	m.off += int64(n)
+	return n, err
+}
+
+// Seek sets the position for the next Read or Write, io.SeekEnd is
+// relative to the end of the 32-bit address space
+func (m *TargetMemory) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += addressSpaceSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.off = offset
+	return offset, nil
+}
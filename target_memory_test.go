@@ -0,0 +1,62 @@
+package stlink_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/rikvdh/go-stlink"
+	"github.com/rikvdh/go-stlink/sim"
+)
+
+func TestTargetMemory(t *testing.T) {
+	dev, p := openSim(t, sim.STM32F103xB)
+	defer dev.Close()
+	m := dev.Memory()
+
+	if pos, err := m.Seek(0x20000010, io.SeekStart); err != nil || pos != 0x20000010 {
+		t.Fatalf("Seek() = %x, %v", pos, err)
+	}
+	if n, err := m.Write([]byte("target")); n != 6 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if pos, err := m.Seek(-6, io.SeekCurrent); err != nil || pos != 0x20000010 {
+		t.Fatalf("Seek() = %x, %v", pos, err)
+	}
+	buf := make([]byte, 6)
+	if n, err := io.ReadFull(m, buf); n != 6 || err != nil || string(buf) != "target" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+	if _, err := m.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+
+	// the end of the address space
+	if pos, err := m.Seek(-2, io.SeekEnd); err != nil || pos != 0xfffffffe {
+		t.Fatalf("Seek() = %x, %v", pos, err)
+	}
+	if n, err := m.Read(buf); n != 2 || err != io.EOF {
+		t.Errorf("Read() at the end = %d, %v", n, err)
+	}
+	if n, err := m.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read() past the end = %d, %v", n, err)
+	}
+	if n, err := m.WriteAt([]byte{1, 2, 3, 4}, 0xfffffffe); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("WriteAt() at the end = %d, %v", n, err)
+	}
+
+	// a bus fault in the middle
+	p.Target.MapFault(0x20001000, 0x100)
+	if n, err := m.WriteAt(bytes.Repeat([]byte{0xaa}, 16), 0x20000ff6); n != 10 || !errors.Is(err, stlink.ErrSWDAPFault) {
+		t.Errorf("WriteAt() over a fault = %d, %v", n, err)
+	}
+	if got := targetBytes(p.Target, 0x20000ff6, 10); !bytes.Equal(got, bytes.Repeat([]byte{0xaa}, 10)) {
+		t.Errorf("target memory before the fault % x", got)
+	}
+	buf = make([]byte, 16)
+	if n, err := m.ReadAt(buf, 0x20000ff6); n != 10 || !errors.Is(err, stlink.ErrSWDAPFault) ||
+		!bytes.Equal(buf[:n], bytes.Repeat([]byte{0xaa}, 10)) {
+		t.Errorf("ReadAt() over a fault = % x, %v", buf[:n], err)
+	}
+}
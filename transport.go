@@ -0,0 +1,19 @@
+package stlink
+
+import "context"
+
+// Transport is the link between a Device and an ST-link probe. A Device
+// only talks to a probe through its Transport, which makes it possible to
+// swap the USB connection for something else (a simulator, a recording...).
+//
+// A transfer gives up when ctx is done, it then returns ctx.Err().
+type Transport interface {
+	// SendCommand sends a single command block to the probe
+	SendCommand(ctx context.Context, cmd []byte) error
+	// SendData sends the bulk data phase of the preceding command
+	SendData(ctx context.Context, data []byte) error
+	// Receive reads exactly n bytes of response or bulk data from the probe
+	Receive(ctx context.Context, n int) ([]byte, error)
+	// Close releases the probe
+	Close() error
+}
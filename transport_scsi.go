@@ -0,0 +1,207 @@
+package stlink
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The ST-link V1 is a USB mass-storage device, its commands are wrapped
+// in SCSI command blocks using the bulk-only transport: every command is
+// a command block wrapper (CBW) holding the ST-link command as CDB, an
+// optional data phase and a command status wrapper (CSW).
+
+const (
+	scsiCBWSignature uint32 = 0x43425355 // "USBC"
+	scsiCSWSignature uint32 = 0x53425355 // "USBS"
+
+	scsiCBWSize = 31
+	scsiCSWSize = 13
+	// scsiMaxCDBSize is the longest command the V1 accepts
+	scsiMaxCDBSize = 10
+
+	scsiDirOut uint8 = 0x00
+	scsiDirIn  uint8 = 0x80
+
+	scsiCmdRequestSense = 0x03
+	scsiSenseSize       = 18
+)
+
+// SCSIError is returned when the V1 reports a failed command, it holds
+// the sense data of the failure
+type SCSIError struct {
+	SenseKey uint8
+	ASC      uint8
+	ASCQ     uint8
+}
+
+func (e *SCSIError) Error() string {
+	return fmt.Sprintf("scsi command failed: sense key %x, asc %02x, ascq %02x", e.SenseKey, e.ASC, e.ASCQ)
+}
+
+// scsiTransport wraps the commands of a Device in SCSI for the V1. t is
+// the raw bulk transport, its SendData and Receive are plain bulk
+// transfers.
+//
+// The CBW needs the direction and length of the data phase, which are
+// not known until the Device sends data or reads a response. So a
+// command is held back until then, or sent without a data phase when
+// the next command arrives.
+//
+// After a failed transfer the CSW of the command may still arrive. Until
+// it is read, Receive without a command discards whatever the probe
+// sends, which is how a Device drains the probe after a timeout.
+type scsiTransport struct {
+	t       Transport
+	tag     uint32
+	pending []byte
+	// stale is set while the CSW of the last command is unread
+	stale bool
+}
+
+func newSCSITransport(t Transport) *scsiTransport {
+	return &scsiTransport{t: t}
+}
+
+func (s *scsiTransport) SendCommand(ctx context.Context, cmd []byte) error {
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+	if len(cmd) > cmdSize {
+		return fmt.Errorf("command too long: %d bytes", len(cmd))
+	}
+	s.pending = append([]byte(nil), cmd...)
+	return nil
+}
+
+func (s *scsiTransport) SendData(ctx context.Context, data []byte) error {
+	cdb, err := s.takePending()
+	if err != nil {
+		return err
+	}
+	if err := s.sendCBW(ctx, cdb, scsiDirOut, len(data)); err != nil {
+		return err
+	}
+	if err := s.t.SendData(ctx, data); err != nil {
+		return err
+	}
+	return s.status(ctx, true)
+}
+
+func (s *scsiTransport) Receive(ctx context.Context, n int) ([]byte, error) {
+	if s.pending == nil && s.stale {
+		return s.discard(ctx, n)
+	}
+	cdb, err := s.takePending()
+	if err != nil {
+		return nil, err
+	}
+	return s.receive(ctx, cdb, n, true)
+}
+
+func (s *scsiTransport) Close() error {
+	err := s.flush(context.Background())
+	if cerr := s.t.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *scsiTransport) takePending() ([]byte, error) {
+	if s.pending == nil {
+		return nil, errors.New("scsi: no command pending")
+	}
+	cdb := s.pending
+	s.pending = nil
+	return cdb, nil
+}
+
+// discard reads n bytes of the response of a failed command, up to its
+// CSW
+func (s *scsiTransport) discard(ctx context.Context, n int) ([]byte, error) {
+	rx, err := s.t.Receive(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(rx) >= scsiCSWSize && binary.LittleEndian.Uint32(rx[0:]) == scsiCSWSignature &&
+		binary.LittleEndian.Uint32(rx[4:]) == s.tag {
+		s.stale = false
+	}
+	return rx, nil
+}
+
+// flush sends a held back command without a data phase
+func (s *scsiTransport) flush(ctx context.Context) error {
+	if s.pending == nil {
+		return nil
+	}
+	cdb, _ := s.takePending()
+	if err := s.sendCBW(ctx, cdb, scsiDirOut, 0); err != nil {
+		return err
+	}
+	return s.status(ctx, true)
+}
+
+func (s *scsiTransport) receive(ctx context.Context, cdb []byte, n int, sense bool) ([]byte, error) {
+	if err := s.sendCBW(ctx, cdb, scsiDirIn, n); err != nil {
+		return nil, err
+	}
+	rx, err := s.t.Receive(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return rx, s.status(ctx, sense)
+}
+
+func (s *scsiTransport) sendCBW(ctx context.Context, cdb []byte, dir uint8, n int) error {
+	if len(cdb) > scsiMaxCDBSize {
+		cdb = cdb[:scsiMaxCDBSize]
+	}
+	s.tag++
+	cbw := make([]byte, scsiCBWSize, scsiCBWSize)
+	binary.LittleEndian.PutUint32(cbw[0:], scsiCBWSignature)
+	binary.LittleEndian.PutUint32(cbw[4:], s.tag)
+	binary.LittleEndian.PutUint32(cbw[8:], uint32(n))
+	cbw[12] = dir
+	cbw[13] = 0 // LUN
+	// The V1 takes the command at its full length, zero padded
+	cbw[14] = scsiMaxCDBSize
+	copy(cbw[15:], cdb)
+	if err := s.t.SendCommand(ctx, cbw); err != nil {
+		return err
+	}
+	s.stale = true
+	return nil
+}
+
+// status reads the CSW of the last command, with sense set a failure is
+// explained by the sense data of the probe
+func (s *scsiTransport) status(ctx context.Context, sense bool) error {
+	csw, err := s.t.Receive(ctx, scsiCSWSize)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(csw[0:]) != scsiCSWSignature {
+		return fmt.Errorf("scsi: invalid status signature: % x", csw[:4])
+	}
+	s.stale = false
+	if tag := binary.LittleEndian.Uint32(csw[4:]); tag != s.tag {
+		return fmt.Errorf("scsi: status tag %d, expected %d", tag, s.tag)
+	}
+	if csw[12] == 0 {
+		return nil
+	}
+	if !sense {
+		return fmt.Errorf("scsi: command failed with status %d", csw[12])
+	}
+	rx, err := s.receive(ctx, []byte{scsiCmdRequestSense, 0, 0, 0, scsiSenseSize, 0}, scsiSenseSize, false)
+	if err != nil {
+		return err
+	}
+	return &SCSIError{
+		SenseKey: rx[2] & 0x0f,
+		ASC:      rx[12],
+		ASCQ:     rx[13],
+	}
+}
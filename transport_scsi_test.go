@@ -0,0 +1,149 @@
+package stlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// bulkV1 is the bulk side of a V1, it answers CBWs from a table of
+// responses keyed by the first two CDB bytes. With hang set nothing is
+// received until it is cleared.
+type bulkV1 struct {
+	t       *testing.T
+	cdbs    [][]byte
+	data    []byte
+	rx      [][]byte
+	fail    map[byte]bool
+	respond map[[2]byte][]byte
+	hang    bool
+}
+
+func (b *bulkV1) SendCommand(ctx context.Context, cbw []byte) error {
+	if len(cbw) != scsiCBWSize || binary.LittleEndian.Uint32(cbw) != scsiCBWSignature ||
+		cbw[14] != scsiMaxCDBSize {
+		return errors.New("invalid CBW")
+	}
+	cdb := cbw[15 : 15+int(cbw[14])]
+	b.cdbs = append(b.cdbs, cdb)
+	n := int(binary.LittleEndian.Uint32(cbw[8:]))
+	if cbw[12] == scsiDirIn {
+		rx := make([]byte, n)
+		if cdb[0] == scsiCmdRequestSense {
+			rx[2], rx[12], rx[13] = 0x05, 0x20, 0x01
+		} else {
+			copy(rx, b.respond[[2]byte{cdb[0], cdb[1]}])
+		}
+		b.rx = append(b.rx, rx)
+	}
+	csw := make([]byte, scsiCSWSize)
+	binary.LittleEndian.PutUint32(csw, scsiCSWSignature)
+	copy(csw[4:8], cbw[4:8])
+	if b.fail[cdb[0]] {
+		csw[12] = 1
+	}
+	b.rx = append(b.rx, csw)
+	return nil
+}
+
+func (b *bulkV1) SendData(ctx context.Context, data []byte) error {
+	b.data = append(b.data, data...)
+	return nil
+}
+
+// Receive reads one packet, like a bulk read a longer read ends at a
+// short packet
+func (b *bulkV1) Receive(ctx context.Context, n int) ([]byte, error) {
+	if b.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if len(b.rx) == 0 {
+		return nil, errors.New("nothing to receive")
+	}
+	rx := b.rx[0]
+	b.rx = b.rx[1:]
+	if len(rx) > n {
+		b.t.Errorf("receive of %d bytes, expected %d", n, len(rx))
+	}
+	return append(rx, make([]byte, n-len(rx))...), nil
+}
+
+func (b *bulkV1) Close() error {
+	return nil
+}
+
+func TestSCSITransport(t *testing.T) {
+	b := &bulkV1{
+		t: t,
+		respond: map[[2]byte][]byte{
+			{0xf5, 0}: {0x02, 0x00},
+		},
+		fail: map[byte]bool{0xf3: true},
+	}
+	s := newSCSITransport(b)
+	ctx := context.Background()
+
+	if err := s.SendCommand(ctx, []byte{0xf5, 0}); err != nil {
+		t.Fatal(err)
+	}
+	rx, err := s.Receive(ctx, 2)
+	if err != nil || !bytes.Equal(rx, []byte{0x02, 0x00}) {
+		t.Errorf("Receive() = % x, %v", rx, err)
+	}
+
+	// a command without response is sent when the next one arrives
+	s.SendCommand(ctx, []byte{0xf2, 0x20, 0xa3})
+	if len(b.cdbs) != 1 {
+		t.Fatalf("command sent before its data phase is known")
+	}
+	s.SendCommand(ctx, []byte{0xf2, 0x08, 0, 0, 0, 0x20, 4, 0})
+	if err := s.SendData(ctx, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.cdbs) != 3 || !bytes.Equal(b.cdbs[1], []byte{0xf2, 0x20, 0xa3, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("unexpected CDBs: % x", b.cdbs)
+	}
+	if !bytes.Equal(b.data, []byte{1, 2, 3, 4}) {
+		t.Errorf("data = % x", b.data)
+	}
+
+	s.SendCommand(ctx, []byte{0xf3, 0x07})
+	err = s.Close()
+	if serr, ok := err.(*SCSIError); !ok || serr.SenseKey != 0x05 || serr.ASC != 0x20 {
+		t.Errorf("Close() = %v, expected sense data", err)
+	}
+}
+
+func TestSCSITransportTimeout(t *testing.T) {
+	b := &bulkV1{
+		t: t,
+		respond: map[[2]byte][]byte{
+			{0xf1, 0}: {0x11, 0x40, 0x83, 0x04, 0x44, 0x37},
+		},
+	}
+	d := &Device{
+		PID:     stlinkV1PID,
+		tr:      newSCSITransport(b),
+		opened:  true,
+		timeout: 20 * time.Millisecond,
+	}
+
+	// the response and CSW arrive after the command timed out
+	b.hang = true
+	if _, err := d.readVersion(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("readVersion of a hanging probe: %v", err)
+	}
+	b.hang = false
+	b.respond[[2]byte{0xf1, 0}] = []byte{0x11, 0x80, 0x83, 0x04, 0x44, 0x37}
+	v, err := d.readVersion()
+	if err != nil || v.Stlink != 1 || v.JTAG != 6 {
+		t.Errorf("readVersion after a timeout = %+v, %v", v, err)
+	}
+	if len(b.rx) != 0 {
+		t.Errorf("%d responses left", len(b.rx))
+	}
+}
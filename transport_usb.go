@@ -0,0 +1,222 @@
+package stlink
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+const (
+	stlinkUsbInEp     = 1
+	stlinkUsbOutEpV1  = 2
+	stlinkUsbOutEpV2  = 2
+	stlinkUsbOutEpV21 = 1
+
+	// usbPacketSize is the max packet size of the bulk endpoints, the
+	// V3 is a high-speed device with larger packets
+	usbPacketSize   = 64
+	usbPacketSizeV3 = 512
+)
+
+// usbTransport is the Transport for ST-links connected through gousb
+type usbTransport struct {
+	dev      *gousb.Device
+	interf   *gousb.Interface
+	doneFunc func()
+	outEp    *gousb.OutEndpoint
+	inEp     *gousb.InEndpoint
+}
+
+func newUSBTransport(dev *gousb.Device) (*usbTransport, error) {
+	var err error
+	t := &usbTransport{dev: dev}
+	if dev.Desc.Product == stlinkV1PID {
+		// The V1 is claimed by the mass-storage driver of the OS
+		if err := dev.SetAutoDetach(true); err != nil {
+			return nil, err
+		}
+	}
+	t.interf, t.doneFunc, err = dev.DefaultInterface()
+	if err != nil {
+		return nil, err
+	}
+	t.inEp, err = t.interf.InEndpoint(stlinkUsbInEp)
+	if err != nil {
+		t.doneFunc()
+		return nil, err
+	}
+
+	// The V2-1 and V3 moved the out endpoint
+	ep := stlinkUsbOutEpV21
+	switch dev.Desc.Product {
+	case stlinkV1PID:
+		ep = stlinkUsbOutEpV1
+	case StlinkV2PID:
+		ep = stlinkUsbOutEpV2
+	}
+
+	t.outEp, err = t.interf.OutEndpoint(ep)
+	if err != nil {
+		t.doneFunc()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *usbTransport) SendCommand(ctx context.Context, cmd []byte) error {
+	_, err := t.outEp.WriteContext(ctx, cmd)
+	return transferError(ctx, err)
+}
+
+func (t *usbTransport) SendData(ctx context.Context, data []byte) error {
+	_, err := t.outEp.WriteContext(ctx, data)
+	return transferError(ctx, err)
+}
+
+func (t *usbTransport) Receive(ctx context.Context, n int) ([]byte, error) {
+	rx := make([]byte, n, n)
+	_, err := t.inEp.ReadContext(ctx, rx)
+	if err != nil {
+		return nil, transferError(ctx, err)
+	}
+	return rx, nil
+}
+
+// transferError turns the error of a transfer cancelled by gousb into
+// the error of ctx, and the error of a probe which is gone into
+// ErrDisconnected
+func transferError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == gousb.TransferNoDevice || err == gousb.ErrorNoDevice || err == gousb.ErrorIO {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	return err
+}
+
+func (t *usbTransport) Close() error {
+	if t.doneFunc != nil {
+		t.doneFunc()
+	}
+	return t.dev.Close()
+}
+
+// usbBackend is the Backend finding ST-links on the USB bus
+type usbBackend struct {
+	usbctx *gousb.Context
+}
+
+func newUSBBackend() *usbBackend {
+	return &usbBackend{
+		usbctx: gousb.NewContext(),
+	}
+}
+
+func (b *usbBackend) probeAll() ([]*gousb.Device, error) {
+	return b.usbctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Vendor == stVID && supportedPID(desc.Product)
+	})
+}
+
+func usbSerialNumber(d *gousb.Device) (string, error) {
+	// 3 is the iSerialNumber, no constant in gousb for this
+	sd, err := d.GetStringDescriptor(3)
+	if err != nil {
+		return "", err
+	}
+	// We check if the device ID is hex-encoded, otherwise do so
+	if _, err := hex.DecodeString(sd); err != nil {
+		sd = hex.EncodeToString([]byte(sd))
+	}
+	return sd, nil
+}
+
+// usbPath returns the physical location of d as bus-port.port...
+func usbPath(d *gousb.Device) string {
+	ports := d.Desc.Path
+	if len(ports) == 0 {
+		ports = []int{d.Desc.Port}
+	}
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = strconv.Itoa(p)
+	}
+	return fmt.Sprintf("%d-%s", d.Desc.Bus, strings.Join(s, "."))
+}
+
+func (b *usbBackend) Probes() ([]ProbeInfo, error) {
+	var probes []ProbeInfo
+
+	devs, err := b.probeAll()
+	defer func() {
+		for _, d := range devs {
+			d.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devs {
+		sd, err := usbSerialNumber(d)
+		if err != nil {
+			return nil, err
+		}
+		// The strings are informative only, a probe without them is
+		// still usable
+		manufacturer, _ := d.Manufacturer()
+		product, _ := d.Product()
+		probes = append(probes, ProbeInfo{
+			PID:          d.Desc.Product,
+			SerialNumber: sd,
+			Path:         usbPath(d),
+			Manufacturer: manufacturer,
+			Product:      product,
+		})
+	}
+	return probes, nil
+}
+
+func (b *usbBackend) Open(p ProbeInfo) (Transport, error) {
+	devs, err := b.probeAll()
+	if err != nil {
+		for _, d := range devs {
+			d.Close()
+		}
+		return nil, err
+	}
+	var found *gousb.Device
+	for _, d := range devs {
+		if found == nil && d.Desc.Product == p.PID && (p.Path == "" || usbPath(d) == p.Path) {
+			if sd, err := usbSerialNumber(d); err == nil && sd == p.SerialNumber {
+				found = d
+				continue
+			}
+		}
+		d.Close()
+	}
+	if found == nil {
+		return nil, errors.New("device not found")
+	}
+	t, err := newUSBTransport(found)
+	if err != nil {
+		found.Close()
+		return nil, err
+	}
+	if p.PID == stlinkV1PID {
+		return newSCSITransport(t), nil
+	}
+	return t, nil
+}
+
+func (b *usbBackend) Close() error {
+	return b.usbctx.Close()
+}
@@ -0,0 +1,120 @@
+package stlink
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// DefaultWatchInterval is the time between two scans for probes by
+// Watch, unless it is changed with WatchOptions.Interval
+const DefaultWatchInterval = 500 * time.Millisecond
+
+// WatchOptions are the options of Watch
+type WatchOptions struct {
+	// Interval is the time between two scans, DefaultWatchInterval when
+	// zero
+	Interval time.Duration
+}
+
+// ProbeEventType is the kind of change reported by Watch
+type ProbeEventType uint8
+
+const (
+	ProbeArrived ProbeEventType = iota
+	ProbeRemoved
+)
+
+func (t ProbeEventType) String() string {
+	switch t {
+	case ProbeArrived:
+		return "arrived"
+	case ProbeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ProbeEvent reports a probe which is plugged in or removed
+type ProbeEvent struct {
+	Type  ProbeEventType
+	Probe ProbeInfo
+	// Name is the model name of the probe, see Device.Name
+	Name string
+}
+
+// probeKey identifies a probe, clones may share a serial number but
+// not a path
+type probeKey struct {
+	pid    gousb.ID
+	serial string
+	path   string
+}
+
+func keyOf(p ProbeInfo) probeKey {
+	return probeKey{pid: p.PID, serial: p.SerialNumber, path: p.Path}
+}
+
+// Watch reports probes being plugged in and removed until ctx is done,
+// after which the channel is closed. The probes attached when Watch is
+// called are reported as arrived first. Probes are found by scanning
+// periodically, a failed scan is tried again on the next one. At most one
+// WatchOptions is used.
+func (s *Stlink) Watch(ctx context.Context, opts ...WatchOptions) <-chan ProbeEvent {
+	interval := DefaultWatchInterval
+	if len(opts) > 0 && opts[0].Interval > 0 {
+		interval = opts[0].Interval
+	}
+	ch := make(chan ProbeEvent)
+	go func() {
+		defer close(ch)
+		known := map[probeKey]ProbeInfo{}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if probes, err := s.backend.Probes(); err == nil {
+				for _, ev := range diffProbes(known, probes) {
+					select {
+					case ch <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// diffProbes updates known to probes and returns the changes
+func diffProbes(known map[probeKey]ProbeInfo, probes []ProbeInfo) []ProbeEvent {
+	var events []ProbeEvent
+	present := map[probeKey]bool{}
+	for _, p := range probes {
+		k := keyOf(p)
+		present[k] = true
+		if _, ok := known[k]; !ok {
+			known[k] = p
+			events = append(events, newProbeEvent(ProbeArrived, p))
+		}
+	}
+	for k, p := range known {
+		if !present[k] {
+			delete(known, k)
+			events = append(events, newProbeEvent(ProbeRemoved, p))
+		}
+	}
+	return events
+}
+
+func newProbeEvent(t ProbeEventType, p ProbeInfo) ProbeEvent {
+	// an unknown model keeps an empty name
+	name, _ := probeName(p.PID)
+	return ProbeEvent{Type: t, Probe: p, Name: name}
+}